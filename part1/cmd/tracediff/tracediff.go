@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"part1/sim8086"
+)
+
+func usage() {
+	log.Fatalf("Usage: %s <trace a> <trace b>", os.Args[0])
+}
+
+// Reports the first step at which two JSON traces, written by the simulator
+// with -trace=json, differ. Exits with status 1 if they do.
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("[tracediff] ")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usage()
+	}
+	a, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer a.Close()
+	b, err := os.Open(flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer b.Close()
+	d, err := sim8086.FirstDivergence(a, b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if d == nil {
+		log.Print("traces are the same")
+		return
+	}
+	fmt.Println(d)
+	os.Exit(1)
+}
@@ -0,0 +1,279 @@
+package sim8086
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// The flags set by arithmetic and logic operations. Other flags are left
+// untouched by them.
+const arithFlags = FlagC | FlagP | FlagA | FlagZ | FlagS | FlagO
+
+var ErrDivide = errors.New("divide error")
+
+// Returns the value as well as the flags register after the arithmetic or
+// logic operation (OpAdd, OpAdc, OpSub, OpSbb, OpCmp, OpAnd, OpOr, OpXor,
+// OpTest, OpInc, OpDec, OpNeg, OpNot) on the byte or word values a and b.
+// Only the low byte of a and b is used for byte operations. The single
+// operand operations ignore b.
+func applyArithmetic(op Op, word bool, a, b uint16, flagsIn Flags) (value uint16, flags Flags) {
+	mask, signBit := widthMask(word)
+	a, b = a&mask, b&mask
+	var carry uint16
+	if flagsIn&FlagC != 0 {
+		carry = 1
+	}
+	// Inc and dec are add and sub that keep the carry flag, and neg is a
+	// subtraction from zero.
+	keep := Flags(0)
+	switch op {
+	case OpAdc, OpSbb:
+	case OpInc, OpDec:
+		b, carry, keep = 1, 0, FlagC
+	case OpNeg:
+		a, b, carry = 0, a, 0
+	case OpNot:
+		return ^a & mask, flagsIn
+	default:
+		carry = 0
+	}
+	switch op {
+	case OpAdd, OpAdc, OpInc:
+		sum := uint32(a) + uint32(b) + uint32(carry)
+		value = uint16(sum) & mask
+		flags |= boolToInt(sum > uint32(mask)) * FlagC
+		flags |= boolToInt((a^b^value)&0x10 != 0) * FlagA
+		flags |= overflowFlag(OpAdd, word, a, b, carry)
+	case OpSub, OpSbb, OpCmp, OpDec, OpNeg:
+		value = (a - b - carry) & mask
+		flags |= boolToInt(uint32(a) < uint32(b)+uint32(carry)) * FlagC
+		flags |= boolToInt((a^b^value)&0x10 != 0) * FlagA
+		flags |= overflowFlag(OpSub, word, a, b, carry)
+	case OpAnd, OpTest:
+		value = a & b
+	case OpOr:
+		value = a | b
+	case OpXor:
+		value = a ^ b
+	}
+	flags |= resultFlags(value, signBit)
+	flags = flags&^keep | flagsIn&keep
+	return value, flagsIn&^arithFlags | flags
+}
+
+// Returns the value as well as the flags register after shifting or rotating
+// the byte or word value a count times. Rotates only change the carry and
+// overflow flags, and a count of zero changes no flags at all.
+func applyShift(op Op, word bool, a uint16, count uint8, flagsIn Flags) (value uint16, flags Flags) {
+	if count == 0 {
+		return a, flagsIn
+	}
+	mask, signBit := widthMask(word)
+	value = a & mask
+	carry := flagsIn&FlagC != 0
+	for i := uint8(0); i < count; i++ {
+		msb, lsb := value&signBit != 0, value&1 != 0
+		switch op {
+		case OpShl:
+			value, carry = value<<1, msb
+		case OpShr:
+			value, carry = value>>1, lsb
+		case OpSar:
+			value, carry = value>>1|value&signBit, lsb
+		case OpRol:
+			value, carry = value<<1|boolToInt(msb), msb
+		case OpRor:
+			value, carry = value>>1|boolToInt(lsb)*signBit, lsb
+		case OpRcl:
+			value, carry = value<<1|boolToInt(carry), msb
+		case OpRcr:
+			value, carry = value>>1|boolToInt(carry)*signBit, lsb
+		}
+		value &= mask
+	}
+	// The overflow flag is only defined for single bit shifts, where it tells
+	// whether the sign changed. It is computed the same way for all counts.
+	var overflow bool
+	switch op {
+	case OpShl, OpRol, OpRcl:
+		overflow = (value&signBit != 0) != carry
+	case OpShr:
+		overflow = a&signBit != 0
+	case OpRor, OpRcr:
+		overflow = (value^value<<1)&signBit != 0
+	}
+	flags = boolToInt(carry)*FlagC | boolToInt(overflow)*FlagO
+	switch op {
+	case OpShl, OpShr, OpSar:
+		flags |= resultFlags(value, signBit)
+		return value, flagsIn&^arithFlags | flags
+	}
+	return value, flagsIn&^(FlagC|FlagO) | flags
+}
+
+// Executes multiplication or division of the accumulator (al/ax for bytes,
+// ax/dx:ax for words) by src. The flags other than carry and overflow for
+// multiplication are undefined and left untouched, as are all the flags for
+// division.
+func applyMulDiv(regs *Registers, op Op, word bool, src uint16) error {
+	if !word {
+		src &= 0xff
+		al := regs[RegAx] & 0xff
+		switch op {
+		case OpMul:
+			regs[RegAx] = al * src
+			setMulFlags(regs, regs[RegAx]>>8 != 0)
+		case OpImul:
+			res := int16(int8(al)) * int16(int8(src))
+			regs[RegAx] = uint16(res)
+			setMulFlags(regs, int16(int8(res)) != res)
+		case OpDiv:
+			ax := regs[RegAx]
+			if src == 0 || ax/src > 0xff {
+				return ErrDivide
+			}
+			regs[RegAx] = (ax%src)<<8 | ax/src
+		case OpIdiv:
+			ax, s := int16(regs[RegAx]), int16(int8(src))
+			if s == 0 {
+				return ErrDivide
+			}
+			// The 8086 does not allow the most negative quotient.
+			q, r := int32(ax)/int32(s), int32(ax)%int32(s)
+			if q > 0x7f || q < -0x7f {
+				return ErrDivide
+			}
+			regs[RegAx] = uint16(uint8(r))<<8 | uint16(uint8(q))
+		}
+		return nil
+	}
+	ax := regs[RegAx]
+	switch op {
+	case OpMul:
+		res := uint32(ax) * uint32(src)
+		regs[RegDx], regs[RegAx] = uint16(res>>16), uint16(res)
+		setMulFlags(regs, regs[RegDx] != 0)
+	case OpImul:
+		res := int32(int16(ax)) * int32(int16(src))
+		regs[RegDx], regs[RegAx] = uint16(res>>16), uint16(res)
+		setMulFlags(regs, int32(int16(res)) != res)
+	case OpDiv:
+		num := uint32(regs[RegDx])<<16 | uint32(ax)
+		if src == 0 || num/uint32(src) > 0xffff {
+			return ErrDivide
+		}
+		regs[RegAx], regs[RegDx] = uint16(num/uint32(src)), uint16(num%uint32(src))
+	case OpIdiv:
+		num, s := int32(uint32(regs[RegDx])<<16|uint32(ax)), int32(int16(src))
+		if s == 0 {
+			return ErrDivide
+		}
+		q, r := int64(num)/int64(s), int64(num)%int64(s)
+		if q > 0x7fff || q < -0x7fff {
+			return ErrDivide
+		}
+		regs[RegAx], regs[RegDx] = uint16(q), uint16(r)
+	}
+	return nil
+}
+
+func setMulFlags(regs *Registers, upperHalf bool) {
+	regs[RegFlags] &^= FlagC | FlagO
+	regs[RegFlags] |= boolToInt(upperHalf) * (FlagC | FlagO)
+}
+
+// Executes the decimal and ASCII adjust instructions, as well as the sign
+// extensions cbw and cwd. Base is the number base of aam and aad.
+func applyAdjust(regs *Registers, op Op, base uint8) error {
+	al, ah := uint8(regs[RegAx]), uint8(regs[RegAx]>>8)
+	flags := regs[RegFlags]
+	carry, auxCarry := flags&FlagC != 0, flags&FlagA != 0
+	switch op {
+	case OpCbw:
+		regs[RegAx] = uint16(int16(int8(al)))
+		return nil
+	case OpCwd:
+		regs[RegDx] = uint16(int16(regs[RegAx]) >> 15)
+		return nil
+	case OpDaa, OpDas:
+		oldAl := al
+		if al&0xf > 9 || auxCarry {
+			if op == OpDaa {
+				al += 6
+			} else {
+				al -= 6
+			}
+			auxCarry = true
+		}
+		if oldAl > 0x99 || carry {
+			if op == OpDaa {
+				al += 0x60
+			} else {
+				al -= 0x60
+			}
+			carry = true
+		}
+	case OpAaa, OpAas:
+		carry = al&0xf > 9 || auxCarry
+		auxCarry = carry
+		if carry {
+			if op == OpAaa {
+				al, ah = al+6, ah+1
+			} else {
+				al, ah = al-6, ah-1
+			}
+		}
+		al &= 0xf
+	case OpAam:
+		if base == 0 {
+			return ErrDivide
+		}
+		al, ah = al%base, al/base
+	case OpAad:
+		al, ah = al+ah*base, 0
+	}
+	regs[RegAx] = uint16(ah)<<8 | uint16(al)
+	flags &^= FlagC | FlagA | FlagS | FlagZ | FlagP
+	switch op {
+	case OpDaa, OpDas, OpAaa, OpAas:
+		flags |= boolToInt(carry)*FlagC | boolToInt(auxCarry)*FlagA
+	}
+	regs[RegFlags] = flags | resultFlags(uint16(al), 1<<7)
+	return nil
+}
+
+// Returns the sign, zero and parity flags of the result.
+func resultFlags(value, signBit uint16) Flags {
+	var flags Flags
+	flags |= boolToInt(value&signBit != 0) * FlagS
+	flags |= boolToInt(value == 0) * FlagZ
+	// Parity is only calculated on lower byte
+	flags |= boolToInt(bits.OnesCount16(value&0xff)%2 == 0) * FlagP
+	return flags
+}
+
+func widthMask(word bool) (mask, signBit uint16) {
+	if word {
+		return 0xffff, 1 << 15
+	}
+	return 0xff, 1 << 7
+}
+
+// Signed overflow of a+b+carry (OpAdd) or a-b-carry (OpSub).
+func overflowFlag(op Op, word bool, a, b, carry uint16) Flags {
+	if word {
+		return overflow(op, int16(a), int16(b), int(carry))
+	}
+	return overflow(op, int8(a), int8(b), int(carry))
+}
+
+func overflow[T int16 | int8](op Op, a, b T, carry int) Flags {
+	r := int(a) + int(b) + carry
+	if op == OpSub {
+		r = int(a) - int(b) - carry
+	}
+	if int(T(r)) != r {
+		return FlagO
+	}
+	return 0
+}
@@ -0,0 +1,735 @@
+package sim8086
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrSyntax         = errors.New("syntax error")
+	ErrUndefinedLabel = errors.New("undefined label")
+	ErrJumpOutOfRange = errors.New("jump out of range")
+)
+
+// AsmError records the line of the source that could not be assembled.
+type AsmError struct {
+	Line int
+	Err  error
+}
+
+func (e *AsmError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *AsmError) Unwrap() error {
+	return e.Err
+}
+
+// Assemble assembles NASM syntax source into machine code. It accepts the
+// NASM that Disassemble writes, as well as what the listings in testdata are
+// written in: labels, expressions of numbers and labels, short, near and far
+// jumps, segment overrides and the bits, org, db and dw directives. Where
+// there is a choice of encodings the same one as NASM's is picked, see
+// Encode.
+func Assemble(src string) ([]byte, error) {
+	stmts, err := parseSource(src)
+	if err != nil {
+		return nil, err
+	}
+	a := &assembler{labels: make(map[string]int)}
+	// Labels may be used before they are defined, and a jmp is only
+	// lengthened to a near jump when its target is out of reach. Assemble
+	// until the addresses of all labels stay the same.
+	for pass := 0; pass < maxPasses; pass++ {
+		a.changed = false
+		if _, err := a.assemble(stmts); err != nil {
+			return nil, err
+		}
+		if !a.changed {
+			a.final = true
+			return a.assemble(stmts)
+		}
+	}
+	return nil, fmt.Errorf("%w: labels did not settle after %d passes", ErrSyntax, maxPasses)
+}
+
+const maxPasses = 16
+
+// A line of source, split into its parts.
+type statement struct {
+	line     int
+	label    string
+	prefix   Prefix
+	mnemonic string
+	args     []string
+	// A jmp without an explicit distance that has to be a near jump to
+	// reach its target.
+	near bool
+}
+
+// Splits the source into statements. Comments and blank lines are dropped.
+func parseSource(src string) ([]*statement, error) {
+	var stmts []*statement
+	for i, line := range strings.Split(src, "\n") {
+		st := &statement{line: i + 1}
+		line = strings.TrimSpace(strings.ReplaceAll(stripComment(line), "\t", " "))
+		if name, rest, ok := strings.Cut(line, ":"); ok && isIdentifier(name) && !isRegisterName(name) {
+			st.label, line = name, strings.TrimSpace(rest)
+		}
+		for line != "" {
+			word, rest, _ := strings.Cut(line, " ")
+			if !st.prefix.AddName(strings.ToLower(word)) {
+				break
+			}
+			line = strings.TrimSpace(rest)
+		}
+		if line != "" {
+			mnemonic, rest, _ := strings.Cut(line, " ")
+			st.mnemonic = strings.ToLower(mnemonic)
+			var err error
+			if st.args, err = splitArgs(rest); err != nil {
+				return nil, &AsmError{st.line, err}
+			}
+		} else if st.prefix != (Prefix{}) {
+			return nil, &AsmError{st.line, fmt.Errorf("%w: prefix without instruction", ErrSyntax)}
+		}
+		if st.label != "" || st.mnemonic != "" {
+			stmts = append(stmts, st)
+		}
+	}
+	return stmts, nil
+}
+
+// AddName records the prefix with the given name and reports whether it is
+// a prefix at all.
+func (p *Prefix) AddName(name string) bool {
+	switch name {
+	case "lock":
+		p.Lock = true
+	case "rep", "repe", "repz":
+		p.Rep = Rep
+	case "repne", "repnz":
+		p.Rep = Repne
+	case "es", "cs", "ss", "ds":
+		code, _ := segmentCode(registerByName[name])
+		p.Seg = SegOverride(code + 1)
+	default:
+		return false
+	}
+	return true
+}
+
+// Returns the line up to a comment, taking care of semicolons in strings.
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == ';':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Splits the operands at the commas that are not in brackets, parentheses or
+// strings.
+func splitArgs(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	var args []string
+	var quote rune
+	depth, start := 0, 0
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	args = append(args, strings.TrimSpace(s[start:]))
+	if quote != 0 || depth != 0 {
+		return nil, fmt.Errorf("%w: unbalanced %q", ErrSyntax, s)
+	}
+	for _, arg := range args {
+		if arg == "" {
+			return nil, fmt.Errorf("%w: missing operand in %q", ErrSyntax, s)
+		}
+	}
+	return args, nil
+}
+
+type assembler struct {
+	labels map[string]int
+	// Labels defined in the current pass.
+	defined map[string]bool
+	// Set when a label moved, or a jump had to be lengthened, in the current
+	// pass.
+	changed bool
+	// In the final pass labels have settled, so that undefined labels and
+	// jumps out of range are errors.
+	final bool
+	// Address of the start of the output, and of the current statement.
+	origin, addr int
+	// Set when an expression used a label that is not defined yet.
+	unresolved bool
+}
+
+func (a *assembler) assemble(stmts []*statement) ([]byte, error) {
+	var code []byte
+	a.defined = make(map[string]bool)
+	a.origin, a.addr = 0, 0
+	for _, st := range stmts {
+		b, err := a.statement(st, len(code) == 0)
+		if err != nil {
+			return nil, &AsmError{st.line, err}
+		}
+		code = append(code, b...)
+		a.addr += len(b)
+	}
+	return code, nil
+}
+
+func (a *assembler) statement(st *statement, atStart bool) ([]byte, error) {
+	if st.label != "" {
+		if a.defined[st.label] {
+			return nil, fmt.Errorf("%w: label %s defined twice", ErrSyntax, st.label)
+		}
+		if old, ok := a.labels[st.label]; !ok || old != a.addr {
+			a.changed = true
+		}
+		a.labels[st.label], a.defined[st.label] = a.addr, true
+	}
+	a.unresolved = false
+	switch st.mnemonic {
+	case "":
+		return nil, nil
+	case "bits":
+		if len(st.args) != 1 || st.args[0] != "16" {
+			return nil, fmt.Errorf("%w: only bits 16 is supported", ErrSyntax)
+		}
+		return nil, nil
+	case "org":
+		if len(st.args) != 1 || !atStart {
+			return nil, fmt.Errorf("%w: org takes an address and must come first", ErrSyntax)
+		}
+		v, err := a.value(st.args[0], 0, 0xffff)
+		a.origin, a.addr = v, v
+		return nil, err
+	case "db", "dw":
+		return a.data(st)
+	}
+	in, err := a.instruction(st)
+	if err != nil {
+		return nil, err
+	}
+	return encode(in)
+}
+
+// Returns the bytes of a db or dw directive.
+func (a *assembler) data(st *statement) ([]byte, error) {
+	var code []byte
+	word := st.mnemonic == "dw"
+	for _, arg := range st.args {
+		if s, ok := stringLiteral(arg); ok {
+			code = append(code, s...)
+			if word && len(s)%2 == 1 {
+				code = append(code, 0)
+			}
+			continue
+		}
+		lo, hi := -0x80, 0xff
+		if word {
+			lo, hi = -0x8000, 0xffff
+		}
+		v, err := a.value(arg, lo, hi)
+		if err != nil {
+			return nil, err
+		}
+		code = append(code, byte(v))
+		if word {
+			code = append(code, byte(v>>8))
+		}
+	}
+	return code, nil
+}
+
+// Returns the instruction of the statement, with relative jumps resolved
+// against the address of the statement.
+func (a *assembler) instruction(st *statement) (Instruction, error) {
+	in := Instruction{Prefix: st.prefix}
+	op, ok := opByName[st.mnemonic]
+	if !ok {
+		if st.mnemonic != "nop" || len(st.args) != 0 {
+			return in, fmt.Errorf("%w: unknown instruction %q", ErrSyntax, st.mnemonic)
+		}
+		ax := OperandReg{RegAx, WidthFull}
+		in = NewInstruction(OpXchg, unsized(ax), unsized(ax))
+		in.Prefix = st.prefix
+		return in, nil
+	}
+	in.Op = op
+	if len(st.args) > 2 {
+		return in, fmt.Errorf("%w for %s: too many operands", ErrInvalidOperands, op)
+	}
+	var short bool
+	var ops [2]Operand
+	for i, arg := range st.args {
+		o, s, err := a.operand(arg)
+		if err != nil {
+			return in, err
+		}
+		ops[i] = o
+		short = short || s
+	}
+	in.SetOperands(ops[:len(st.args)]...)
+	if !isJumpOp(op) || len(in.Operands()) != 1 {
+		return in, nil
+	}
+	imm, ok := in.Operands()[0].Op().(OperandImm)
+	if !ok {
+		return in, nil
+	}
+	// The operand is the target, make it relative to the end of the
+	// instruction.
+	target := int(uint16(imm))
+	if op == OpJmp && st.near && !short {
+		in.Operands()[0].Size = SizeNear
+	}
+	in.Operands()[0] = NewOperand(in.Operands()[0].Size, OperandImm(0))
+	code, err := encode(in)
+	if err != nil {
+		return in, err
+	}
+	// Offsets wrap around within the segment.
+	rel := int(int16(target - (a.addr + len(code))))
+	in.Size = len(code)
+	near := in.Operands()[0].Size == SizeNear || op == OpCall
+	if !near && (rel < -0x80 || rel >= 0x80) {
+		switch {
+		case a.final:
+			return in, fmt.Errorf("%w: %s to 0x%04x", ErrJumpOutOfRange, op, target)
+		case op == OpJmp && !short && !a.unresolved:
+			// Lengthen to a near jump in the next pass.
+			st.near, a.changed = true, true
+		}
+		rel = 0
+	}
+	in.Operands()[0] = NewOperand(in.Operands()[0].Size, OperandImm(int16(rel)))
+	return in, nil
+}
+
+func isJumpOp(op Op) bool {
+	return OpJe <= op && op <= OpJcxz || op == OpJmp || op == OpCall
+}
+
+// Parses an operand. Short is set for a jump target marked as short.
+func (a *assembler) operand(s string) (o Operand, short bool, err error) {
+	for {
+		word, rest, _ := strings.Cut(s, " ")
+		switch strings.ToLower(word) {
+		case "byte":
+			o.Size = SizeByte
+		case "word":
+			o.Size = SizeWord
+		case "near":
+			o.Size = SizeNear
+		case "far":
+			o.Size = SizeFar
+		case "short":
+			short = true
+		default:
+			goto parsed
+		}
+		s = strings.TrimSpace(rest)
+	}
+parsed:
+	if r, ok := registerByName[strings.ToLower(s)]; ok {
+		if o.Size != SizeNone {
+			return o, short, fmt.Errorf("%w: size on register %s", ErrSyntax, s)
+		}
+		o = unsized(r)
+		return o, short, nil
+	}
+	if open := strings.Index(s, "["); open >= 0 {
+		d, err := a.memory(s, open)
+		return NewOperand(o.Size, d), short, err
+	}
+	if seg, offset, ok := cutTopLevel(s, ':'); ok {
+		var p OperandFarPtr
+		v, err := a.value(seg, 0, 0xffff)
+		if err != nil {
+			return o, short, err
+		}
+		w, err := a.value(offset, 0, 0xffff)
+		p.Seg, p.Offset = uint16(v), uint16(w)
+		o = NewOperand(o.Size, p)
+		return o, short, err
+	}
+	v, err := a.value(s, -0x8000, 0xffff)
+	o = NewOperand(o.Size, OperandImm(int16(v)))
+	return o, short, err
+}
+
+// Parses a memory operand, [seg:expr] or seg:[expr], where open is the index
+// of the opening bracket.
+func (a *assembler) memory(s string, open int) (OperandDisplacement, error) {
+	var d OperandDisplacement
+	if !strings.HasSuffix(s, "]") {
+		return d, fmt.Errorf("%w: expected ] at the end of %q", ErrSyntax, s)
+	}
+	inner := strings.TrimSpace(s[open+1 : len(s)-1])
+	seg := strings.TrimSpace(s[:open])
+	if seg != "" {
+		if !strings.HasSuffix(seg, ":") {
+			return d, fmt.Errorf("%w: unexpected %q before [", ErrSyntax, seg)
+		}
+		seg = strings.TrimSpace(strings.TrimSuffix(seg, ":"))
+	} else if prefix, rest, ok := cutTopLevel(inner, ':'); ok {
+		seg, inner = strings.TrimSpace(prefix), rest
+	}
+	if seg != "" {
+		var p Prefix
+		if !p.AddName(strings.ToLower(seg)) || p.Seg == SegNone {
+			return d, fmt.Errorf("%w: %q is not a segment register", ErrSyntax, seg)
+		}
+		d.Seg = p.Seg
+	}
+	e := &exprParser{a: a, s: inner, registers: true}
+	v, err := e.parse()
+	if err != nil {
+		return d, err
+	}
+	if e.unresolved {
+		v.v = 0
+	}
+	if v.v < -0x8000 || v.v > 0xffff {
+		return d, fmt.Errorf("%w: displacement %d out of range", ErrSyntax, v.v)
+	}
+	d.Imm = OperandImm(int16(v.v))
+	var kind DisplacementKind
+	for kind = DispBxSi; kind <= DispEA; kind++ {
+		if v.regs == addressRegisters[kind] {
+			break
+		}
+	}
+	if kind > DispEA {
+		return d, fmt.Errorf("%w: invalid address [%s]", ErrSyntax, inner)
+	}
+	d.Kind = kind
+	return d, nil
+}
+
+// The registers that make up the address of each displacement kind, as a
+// set of bits by register.
+var addressRegisters = [...]uint32{
+	DispBxSi: 1<<RegBx | 1<<RegSi,
+	DispBxDi: 1<<RegBx | 1<<RegDi,
+	DispBpSi: 1<<RegBp | 1<<RegSi,
+	DispBpDi: 1<<RegBp | 1<<RegDi,
+	DispSi:   1 << RegSi,
+	DispDi:   1 << RegDi,
+	DispBp:   1 << RegBp,
+	DispBx:   1 << RegBx,
+	DispEA:   0,
+}
+
+// The registers that can be used in an address.
+const baseIndexRegisters = 1<<RegBx | 1<<RegBp | 1<<RegSi | 1<<RegDi
+
+// Returns the value of the expression, which must be in the range lo to hi.
+// Undefined labels are an error in the final pass only.
+func (a *assembler) value(s string, lo, hi int) (int, error) {
+	e := &exprParser{a: a, s: s}
+	v, err := e.parse()
+	if err != nil || e.unresolved {
+		return 0, err
+	}
+	if v.v < lo || v.v > hi {
+		return 0, fmt.Errorf("%w: %d out of range", ErrSyntax, v.v)
+	}
+	return v.v, nil
+}
+
+// Cuts s around the first sep that is not in brackets or parentheses.
+func cutTopLevel(s string, sep byte) (before, after string, found bool) {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[', '(':
+			depth++
+		case ']', ')':
+			depth--
+		case sep:
+			if depth == 0 {
+				return s[:i], s[i+1:], true
+			}
+		}
+	}
+	return s, "", false
+}
+
+// The value of an expression: a number plus, in a memory operand, the set of
+// registers added to it.
+type exprValue struct {
+	v    int
+	regs uint32
+}
+
+// A recursive descent parser for expressions of numbers, characters, labels,
+// $ and $$ with the operators + - * / % ~ and parentheses.
+type exprParser struct {
+	a         *assembler
+	s         string
+	pos       int
+	registers bool // Allow registers, in a memory operand
+	// Set when a label is not defined yet. Until the final pass its value
+	// is taken to be zero.
+	unresolved bool
+}
+
+func (e *exprParser) parse() (exprValue, error) {
+	v, err := e.sum()
+	if err == nil && e.skipSpace() < len(e.s) {
+		err = fmt.Errorf("%w: unexpected %q in %q", ErrSyntax, e.s[e.pos:], e.s)
+	}
+	return v, err
+}
+
+func (e *exprParser) skipSpace() int {
+	for e.pos < len(e.s) && (e.s[e.pos] == ' ' || e.s[e.pos] == '\t') {
+		e.pos++
+	}
+	return e.pos
+}
+
+func (e *exprParser) peek() byte {
+	if e.skipSpace() < len(e.s) {
+		return e.s[e.pos]
+	}
+	return 0
+}
+
+func (e *exprParser) sum() (exprValue, error) {
+	v, err := e.product()
+	for err == nil && (e.peek() == '+' || e.peek() == '-') {
+		c := e.s[e.pos]
+		e.pos++
+		var w exprValue
+		if w, err = e.product(); err != nil {
+			break
+		}
+		switch {
+		case c == '-' && w.regs != 0:
+			err = fmt.Errorf("%w: can not subtract a register in %q", ErrSyntax, e.s)
+		case v.regs&w.regs != 0:
+			err = fmt.Errorf("%w: register used twice in %q", ErrSyntax, e.s)
+		case c == '-':
+			v.v -= w.v
+		default:
+			v.v += w.v
+			v.regs |= w.regs
+		}
+	}
+	return v, err
+}
+
+func (e *exprParser) product() (exprValue, error) {
+	v, err := e.unary()
+	for err == nil && (e.peek() == '*' || e.peek() == '/' || e.peek() == '%') {
+		c := e.s[e.pos]
+		e.pos++
+		var w exprValue
+		if w, err = e.unary(); err != nil {
+			break
+		}
+		switch {
+		case v.regs != 0 || w.regs != 0:
+			err = fmt.Errorf("%w: can not scale a register in %q", ErrSyntax, e.s)
+		case c != '*' && w.v == 0:
+			err = fmt.Errorf("%w: division by zero in %q", ErrSyntax, e.s)
+		case c == '*':
+			v.v *= w.v
+		case c == '/':
+			v.v /= w.v
+		default:
+			v.v %= w.v
+		}
+	}
+	return v, err
+}
+
+func (e *exprParser) unary() (exprValue, error) {
+	switch c := e.peek(); c {
+	case '-', '+', '~':
+		e.pos++
+		v, err := e.unary()
+		if err == nil && v.regs != 0 {
+			err = fmt.Errorf("%w: unexpected register in %q", ErrSyntax, e.s)
+		}
+		switch c {
+		case '-':
+			v.v = -v.v
+		case '~':
+			v.v = ^v.v
+		}
+		return v, err
+	}
+	return e.primary()
+}
+
+func (e *exprParser) primary() (exprValue, error) {
+	start := e.skipSpace()
+	if start == len(e.s) {
+		return exprValue{}, fmt.Errorf("%w: missing value in %q", ErrSyntax, e.s)
+	}
+	switch c := e.s[start]; {
+	case c == '(':
+		e.pos++
+		v, err := e.sum()
+		if err == nil && e.peek() != ')' {
+			err = fmt.Errorf("%w: missing ) in %q", ErrSyntax, e.s)
+		}
+		e.pos++
+		return v, err
+	case c == '\'' || c == '"' || c == '`':
+		end := strings.IndexByte(e.s[start+1:], c)
+		if end < 0 {
+			return exprValue{}, fmt.Errorf("%w: unterminated string in %q", ErrSyntax, e.s)
+		}
+		e.pos = start + end + 2
+		var v int
+		for i, b := range []byte(e.s[start+1 : start+1+end]) {
+			v |= int(b) << (8 * i)
+		}
+		return exprValue{v: v}, nil
+	}
+	for e.pos < len(e.s) && isIdentChar(rune(e.s[e.pos])) {
+		e.pos++
+	}
+	tok := e.s[start:e.pos]
+	switch {
+	case tok == "":
+		return exprValue{}, fmt.Errorf("%w: unexpected %q in %q", ErrSyntax, e.s[start:], e.s)
+	case tok == "$":
+		return exprValue{v: e.a.addr}, nil
+	case tok == "$$":
+		return exprValue{v: e.a.origin}, nil
+	case unicode.IsDigit(rune(tok[0])):
+		v, err := parseNumber(tok)
+		if err != nil {
+			return exprValue{}, fmt.Errorf("%w: invalid number %q", ErrSyntax, tok)
+		}
+		return exprValue{v: v}, nil
+	}
+	if r, ok := registerByName[strings.ToLower(tok)]; ok {
+		if !e.registers || r.Width != WidthFull || (1<<r.Name)&baseIndexRegisters == 0 {
+			return exprValue{}, fmt.Errorf("%w: unexpected register %s in %q", ErrSyntax, tok, e.s)
+		}
+		return exprValue{regs: 1 << r.Name}, nil
+	}
+	v, ok := e.a.labels[tok]
+	if !ok {
+		e.unresolved, e.a.unresolved = true, true
+		if e.a.final {
+			return exprValue{}, fmt.Errorf("%w %s", ErrUndefinedLabel, tok)
+		}
+	}
+	return exprValue{v: v}, nil
+}
+
+// Parses a number in NASM syntax: decimal, or hexadecimal with a 0x prefix
+// or h suffix, or binary with a 0b prefix.
+func parseNumber(s string) (int, error) {
+	s = strings.ToLower(strings.ReplaceAll(s, "_", ""))
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "0x"):
+		s, base = s[2:], 16
+	case strings.HasPrefix(s, "0b"):
+		s, base = s[2:], 2
+	case strings.HasSuffix(s, "h"):
+		s, base = s[:len(s)-1], 16
+	}
+	v, err := strconv.ParseInt(s, base, 32)
+	return int(v), err
+}
+
+// Returns the contents of a quoted string.
+func stringLiteral(s string) (string, bool) {
+	if len(s) < 2 || s[0] != s[len(s)-1] || !strings.ContainsRune("'\"`", rune(s[0])) {
+		return "", false
+	}
+	return s[1 : len(s)-1], true
+}
+
+func isIdentChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("_.?$@#~", c)
+}
+
+func isIdentifier(s string) bool {
+	if s == "" || unicode.IsDigit(rune(s[0])) || s[0] == '$' {
+		return false
+	}
+	for _, c := range s {
+		if !isIdentChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isRegisterName(s string) bool {
+	_, ok := registerByName[strings.ToLower(s)]
+	return ok
+}
+
+// Registers by name, as printed in the disassembly.
+var registerByName = func() map[string]OperandReg {
+	m := make(map[string]OperandReg)
+	for _, r := range regVal {
+		m[r.String()] = r
+	}
+	for _, r := range segmentRegs {
+		m[regStrsFull[r][WidthFull]] = OperandReg{r, WidthFull}
+	}
+	return m
+}()
+
+// Operations by mnemonic, including the aliases NASM accepts.
+var opByName = func() map[string]Op {
+	m := make(map[string]Op)
+	for i, s := range opStrs {
+		m[s] = Op(i)
+	}
+	for alias, op := range map[string]Op{
+		"jz": OpJe, "jnz": OpJne, "jnge": OpJl, "jge": OpJnl, "jng": OpJle,
+		"jg": OpJnle, "jnae": OpJb, "jc": OpJb, "jae": OpJnb, "jnc": OpJnb,
+		"jna": OpJbe, "ja": OpJnbe, "jpe": OpJp, "jpo": OpJnp,
+		"loope": OpLoopz, "loopne": OpLoopnz, "sal": OpShl, "retn": OpRet,
+		"xlatb": OpXlat,
+	} {
+		m[alias] = op
+	}
+	return m
+}()
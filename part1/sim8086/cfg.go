@@ -0,0 +1,178 @@
+package sim8086
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A BasicBlock is a run of instructions that is only entered at the first
+// one and only left after the last one. Bytes that could not be decoded make
+// up blocks of their own, without successors.
+type BasicBlock struct {
+	Start, End   int // Offset of the first byte and one past the last
+	Instructions []Instruction
+	Data         []byte // Bytes that could not be decoded
+	Succs        []Edge
+}
+
+type EdgeKind uint32
+
+const (
+	// Execution continues with the next instruction, after a branch that is
+	// not taken or a call that returns, or into a jump target.
+	EdgeFallthrough EdgeKind = iota
+	// A jump, loop or call to its target.
+	EdgeTaken
+)
+
+func (k EdgeKind) String() string {
+	switch k {
+	case EdgeFallthrough:
+		return "fallthrough"
+	case EdgeTaken:
+		return "taken"
+	}
+	return fmt.Sprintf("EdgeKind(%d)", uint32(k))
+}
+
+type Edge struct {
+	Kind EdgeKind
+	To   int // Start of the successor block
+}
+
+// CFG is the control-flow graph of a program, its basic blocks in the order
+// of their offsets. Indirect jumps and calls, returns and jumps out of the
+// program have no edges, since their targets are not known statically.
+type CFG struct {
+	Blocks []*BasicBlock
+}
+
+// Reports whether the instruction ends a basic block, and whether execution
+// can continue after it.
+func endsBlock(in Instruction) (ends, fallsThrough bool) {
+	switch in.Op {
+	case OpJmp, OpRet, OpRetf, OpIret:
+		return true, false
+	case OpCall:
+		return true, true
+	}
+	// Conditional jumps, loops and jcxz
+	return in.IsRelJump(), true
+}
+
+// BuildCFG decodes buf linearly, like Disassemble, and splits it into basic
+// blocks at jump targets and after the instructions that transfer control.
+func BuildCFG(buf []byte) *CFG {
+	lines := decodeLines(buf)
+	starts := make(map[int]bool, len(lines))
+	for _, l := range lines {
+		starts[l.ip] = true
+	}
+	// Returns the target of a relative jump if it is the start of a line, so
+	// that a block can start there.
+	target := func(l disasmLine) (int, bool) {
+		if l.data != nil || !l.in.IsRelJump() {
+			return 0, false
+		}
+		t := l.in.Target(l.ip)
+		return t, starts[t]
+	}
+	leaders := map[int]bool{0: true}
+	for i, l := range lines {
+		if l.data != nil {
+			leaders[l.ip] = true
+		}
+		if ends, _ := endsBlock(l.in); l.data != nil || ends {
+			if i+1 < len(lines) {
+				leaders[lines[i+1].ip] = true
+			}
+		}
+		if t, ok := target(l); ok {
+			leaders[t] = true
+		}
+	}
+
+	g := new(CFG)
+	var b *BasicBlock
+	var last disasmLine
+	for i, l := range lines {
+		if leaders[l.ip] {
+			b = &BasicBlock{Start: l.ip}
+			g.Blocks = append(g.Blocks, b)
+		}
+		if l.data != nil {
+			b.Data = l.data
+			b.End = l.ip + len(l.data)
+		} else {
+			b.Instructions = append(b.Instructions, l.in)
+			b.End = l.ip + l.in.Size
+		}
+		last = l
+		if i+1 < len(lines) && !leaders[lines[i+1].ip] {
+			continue
+		}
+		if b.Data != nil {
+			continue
+		}
+		if t, ok := target(last); ok {
+			b.Succs = append(b.Succs, Edge{EdgeTaken, t})
+		}
+		if _, fallsThrough := endsBlock(last.in); fallsThrough && b.End < len(buf) {
+			b.Succs = append(b.Succs, Edge{EdgeFallthrough, b.End})
+		}
+	}
+	return g
+}
+
+// Block returns the block that starts at the offset, or nil if there is none.
+func (g *CFG) Block(start int) *BasicBlock {
+	i := sort.Search(len(g.Blocks), func(i int) bool { return g.Blocks[i].Start >= start })
+	if i < len(g.Blocks) && g.Blocks[i].Start == start {
+		return g.Blocks[i]
+	}
+	return nil
+}
+
+// WriteDOT writes the graph in the Graphviz DOT language. Blocks are named
+// after their offsets and show their disassembly, with the targets of jumps
+// as the names of the blocks. Taken edges are solid and fallthrough edges
+// dashed.
+func (g *CFG) WriteDOT(w io.Writer) {
+	fmt.Fprintln(w, "digraph cfg {")
+	fmt.Fprintln(w, "\tnode [shape=box, fontname=\"monospace\"];")
+	for _, b := range g.Blocks {
+		// Every line ends in \l, which left-justifies it.
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%s:\\l", labelName(b.Start))
+		ip := b.Start
+		for _, in := range b.Instructions {
+			s := in.String()
+			if in.IsRelJump() && g.Block(in.Target(ip)) != nil {
+				s = in.WithLabel(labelName(in.Target(ip)))
+			}
+			fmt.Fprintf(&sb, "%s\\l", dotEscape(s))
+			ip += in.Size
+		}
+		if b.Data != nil {
+			fmt.Fprintf(&sb, "%s\\l", dotEscape(dataString(b.Data)))
+		}
+		fmt.Fprintf(w, "\t%s [label=\"%s\"];\n", labelName(b.Start), sb.String())
+	}
+	for _, b := range g.Blocks {
+		for _, e := range b.Succs {
+			style := ""
+			if e.Kind == EdgeFallthrough {
+				style = " [style=dashed]"
+			}
+			fmt.Fprintf(w, "\t%s -> %s%s;\n", labelName(b.Start), labelName(e.To), style)
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// Escapes a string for a quoted DOT label.
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
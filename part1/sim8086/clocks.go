@@ -0,0 +1,431 @@
+package sim8086
+
+import (
+	"fmt"
+	"strings"
+)
+
+type CPU uint32
+
+const (
+	CPU8086 CPU = iota
+	CPU8088
+)
+
+var cpuStrs = [...]string{
+	"8086", "8088",
+}
+
+func (c CPU) String() string {
+	return cpuStrs[c]
+}
+
+func ParseCPU(s string) (CPU, error) {
+	for i, str := range cpuStrs {
+		if s == str {
+			return CPU(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cpu %q", s)
+}
+
+// Clocks is the estimated number of clocks of an instruction, split up the
+// way the 8086 manual lists them in Table 2-21.
+type Clocks struct {
+	Base    int // Execution clocks
+	EA      int // Effective address calculation
+	Penalty int // Word transfers on an 8-bit bus or at odd addresses
+}
+
+func (c Clocks) Total() int {
+	return c.Base + c.EA + c.Penalty
+}
+
+func (c Clocks) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d", c.Base)
+	if c.EA != 0 {
+		fmt.Fprintf(&sb, " + %dea", c.EA)
+	}
+	if c.Penalty != 0 {
+		fmt.Fprintf(&sb, " + %dp", c.Penalty)
+	}
+	return sb.String()
+}
+
+type operandClass uint32
+
+const (
+	classNone operandClass = iota
+	classReg
+	classSeg
+	classMem
+	classImm
+)
+
+func classify(o Operand) operandClass {
+	switch x := o.Op().(type) {
+	case OperandReg:
+		if x.Name >= RegEs {
+			return classSeg
+		}
+		return classReg
+	case OperandDisplacement:
+		return classMem
+	case OperandImm, OperandImmU:
+		return classImm
+	}
+	return classNone
+}
+
+// EstimateClocks estimates the clocks the instruction takes to execute with
+// the registers as they were before the instruction was executed. Taken
+// tells whether a conditional jump was taken.
+//
+// Where the manual gives a range, such as for multiplication and division,
+// the lower bound is used. Repeated string instructions are estimated with
+// the repetition count in cx.
+func EstimateClocks(cpu CPU, in Instruction, regs *Registers, taken bool) Clocks {
+	var c Clocks
+	// Number of memory transfers, as listed next to the clocks in the manual.
+	var transfers int
+	var dst, src operandClass
+	if len(in.Operands()) > 0 {
+		dst = classify(in.Operands()[0])
+	}
+	if len(in.Operands()) > 1 {
+		src = classify(in.Operands()[1])
+	}
+	isMem := dst == classMem || src == classMem
+	cond := func(yes, no int) int {
+		if taken {
+			return yes
+		}
+		return no
+	}
+	switch in.Op {
+	case OpMov:
+		switch {
+		case in.Kind == KindMemToFromAcc:
+			c.Base, transfers = 10, 1
+		case dst == classMem && src == classImm:
+			c.Base, transfers = 10, 1
+		case dst == classMem:
+			c.Base, transfers = 9, 1
+		case src == classMem:
+			c.Base, transfers = 8, 1
+		case src == classImm:
+			c.Base = 4
+		default:
+			c.Base = 2
+		}
+	case OpAdd, OpAdc, OpSub, OpSbb, OpAnd, OpOr, OpXor:
+		switch {
+		case dst == classMem && src == classImm:
+			c.Base, transfers = 17, 2
+		case dst == classMem:
+			c.Base, transfers = 16, 2
+		case src == classMem:
+			c.Base, transfers = 9, 1
+		case src == classImm:
+			c.Base = 4
+		default:
+			c.Base = 3
+		}
+	case OpCmp:
+		switch {
+		case dst == classMem && src == classImm:
+			c.Base, transfers = 10, 1
+		case isMem:
+			c.Base, transfers = 9, 1
+		case src == classImm:
+			c.Base = 4
+		default:
+			c.Base = 3
+		}
+	case OpTest:
+		switch {
+		case dst == classMem && src == classImm:
+			c.Base, transfers = 11, 1
+		case isMem:
+			c.Base, transfers = 9, 1
+		case in.Kind == KindImmToAcc:
+			c.Base = 4
+		case src == classImm:
+			c.Base = 5
+		default:
+			c.Base = 3
+		}
+	case OpJe, OpJl, OpJle, OpJb, OpJbe, OpJp, OpJo, OpJs,
+		OpJne, OpJnl, OpJnle, OpJnb, OpJnbe, OpJnp, OpJno, OpJns:
+		c.Base = cond(16, 4)
+	case OpLoop:
+		c.Base = cond(17, 5)
+	case OpLoopz:
+		c.Base = cond(18, 6)
+	case OpLoopnz:
+		c.Base = cond(19, 5)
+	case OpJcxz:
+		c.Base = cond(18, 6)
+	case OpJmp:
+		switch {
+		case in.Kind != KindRm:
+			c.Base = 15
+		case dst == classReg:
+			c.Base = 11
+		case in.Operands()[0].Size == SizeFar:
+			c.Base, transfers = 24, 2
+		default:
+			c.Base, transfers = 18, 1
+		}
+	case OpCall:
+		switch {
+		case in.Kind == KindNearJmp:
+			c.Base, transfers = 19, 1
+		case in.Kind == KindFarJmp:
+			c.Base, transfers = 28, 2
+		case dst == classReg:
+			c.Base, transfers = 16, 1
+		case in.Operands()[0].Size == SizeFar:
+			c.Base, transfers = 37, 4
+		default:
+			c.Base, transfers = 21, 2
+		}
+	case OpRet:
+		c.Base, transfers = 8, 1
+		if in.Kind == KindImm16 {
+			c.Base = 12
+		}
+	case OpRetf:
+		c.Base, transfers = 18, 2
+		if in.Kind == KindImm16 {
+			c.Base = 17
+		}
+	case OpInc, OpDec:
+		switch {
+		case isMem:
+			c.Base, transfers = 15, 2
+		case in.Kind == KindReg:
+			c.Base = 2
+		default:
+			c.Base = 3
+		}
+	case OpNeg, OpNot:
+		c.Base = 3
+		if isMem {
+			c.Base, transfers = 16, 2
+		}
+	case OpPush:
+		switch dst {
+		case classMem:
+			c.Base, transfers = 16, 2
+		case classSeg:
+			c.Base, transfers = 10, 1
+		default:
+			c.Base, transfers = 11, 1
+		}
+	case OpPop:
+		c.Base, transfers = 8, 1
+		if isMem {
+			c.Base, transfers = 17, 2
+		}
+	case OpXchg:
+		switch {
+		case in.Kind == KindAccReg:
+			c.Base = 3
+		case isMem:
+			c.Base, transfers = 17, 2
+		default:
+			c.Base = 4
+		}
+	case OpIn, OpOut:
+		c.Base, transfers = 8, 1
+		if dst == classImm || src == classImm {
+			c.Base = 10
+		}
+	case OpXlat:
+		c.Base, transfers = 11, 1
+	case OpLea:
+		c.Base = 2
+	case OpLds, OpLes:
+		c.Base, transfers = 16, 2
+	case OpLahf, OpSahf:
+		c.Base = 4
+	case OpPushf:
+		c.Base, transfers = 10, 1
+	case OpPopf:
+		c.Base, transfers = 8, 1
+	case OpAaa, OpAas, OpDaa, OpDas:
+		c.Base = 4
+	case OpAam:
+		c.Base = 83
+	case OpAad:
+		c.Base = 60
+	case OpCbw:
+		c.Base = 2
+	case OpCwd:
+		c.Base = 5
+	case OpMul, OpImul, OpDiv, OpIdiv:
+		clocks := mulDivClocks[in.Op]
+		c.Base = clocks[0]
+		if isWordOperand(in.Operands()[0]) {
+			c.Base = clocks[1]
+		}
+		if isMem {
+			c.Base, transfers = c.Base+6, 1
+		}
+	case OpShl, OpShr, OpSar, OpRol, OpRor, OpRcl, OpRcr:
+		var bitClocks int
+		if src == classReg {
+			bitClocks = 4 * int(regs[RegCx]&0xff)
+		}
+		switch {
+		case isMem && src == classReg:
+			c.Base, transfers = 20+bitClocks, 2
+		case isMem:
+			c.Base, transfers = 15, 2
+		case src == classReg:
+			c.Base = 8 + bitClocks
+		default:
+			c.Base = 2
+		}
+	case OpMovsb, OpMovsw:
+		c.Base, transfers = stringClocks(in, regs, 18, 17, 2)
+	case OpCmpsb, OpCmpsw:
+		c.Base, transfers = stringClocks(in, regs, 22, 22, 2)
+	case OpScasb, OpScasw:
+		c.Base, transfers = stringClocks(in, regs, 15, 15, 1)
+	case OpLodsb, OpLodsw:
+		c.Base, transfers = stringClocks(in, regs, 12, 13, 1)
+	case OpStosb, OpStosw:
+		c.Base, transfers = stringClocks(in, regs, 11, 10, 1)
+	case OpInt:
+		c.Base, transfers = 51, 5
+	case OpInt3:
+		c.Base, transfers = 52, 5
+	case OpInto:
+		c.Base = cond(53, 4)
+		transfers = cond(5, 0)
+	case OpIret:
+		c.Base, transfers = 24, 3
+	case OpClc, OpCmc, OpStc, OpCld, OpStd, OpCli, OpSti, OpHlt:
+		c.Base = 2
+	case OpWait:
+		c.Base = 3
+	}
+	// Moves between the accumulator and a direct address take no EA time.
+	if d, ok := in.memOperand(); ok && in.Kind != KindMemToFromAcc {
+		c.EA = eaClocks(d, in.form)
+	}
+	if transfers > 0 && isWordTransfer(in) {
+		// The 8088 needs two bus cycles for every word transfer, the 8086 only
+		// when the word is at an odd address.
+		if cpu == CPU8088 || transferAddress(in, regs)&1 == 1 {
+			c.Penalty = 4 * transfers
+		}
+	}
+	if in.Prefix.Lock {
+		c.Base += 2
+	}
+	return c
+}
+
+// Register clocks for byte and word operands of multiplication and division.
+// Memory operands add six clocks on top of that.
+var mulDivClocks = map[Op][2]int{
+	OpMul:  {70, 118},
+	OpImul: {80, 128},
+	OpDiv:  {80, 144},
+	OpIdiv: {101, 165},
+}
+
+// Returns the clocks and memory transfers of a string instruction, given the
+// clocks of a single and of every repeated execution and the transfers of
+// one execution.
+func stringClocks(in Instruction, regs *Registers, single, repeated, transfers int) (int, int) {
+	if in.Prefix.Rep == RepNone {
+		return single, transfers
+	}
+	n := int(regs[RegCx])
+	return 9 + repeated*n, transfers * n
+}
+
+// Effective address calculation time, from Table 2-20 in the manual. A
+// displacement costs the same whatever its value, so it counts if it was
+// encoded, even as zero.
+func eaClocks(d OperandDisplacement, f encodingForm) int {
+	hasDisp := f.dispLen > 0
+	if !f.decoded {
+		// As Encode would encode it: direct addressing of [bp] is not
+		// possible, so it always has a displacement.
+		hasDisp = d.Imm != 0 || d.Kind == DispBp
+	}
+	var clocks int
+	switch d.Kind {
+	case DispEA:
+		clocks = 6
+	case DispBx, DispBp, DispSi, DispDi:
+		clocks = 5
+		if hasDisp {
+			clocks = 9
+		}
+	case DispBpDi, DispBxSi:
+		clocks = 7
+		if hasDisp {
+			clocks = 11
+		}
+	case DispBpSi, DispBxDi:
+		clocks = 8
+		if hasDisp {
+			clocks = 12
+		}
+	}
+	if d.Seg != SegNone {
+		clocks += 2
+	}
+	return clocks
+}
+
+func isWordOperand(o Operand) bool {
+	switch x := o.Op().(type) {
+	case OperandReg:
+		return x.Width == WidthFull
+	case OperandDisplacement:
+		return o.Size == SizeWord || o.Size == SizeFar
+	}
+	return false
+}
+
+// Reports whether the memory transfers of the instruction are word sized.
+func isWordTransfer(in Instruction) bool {
+	switch in.Op {
+	case OpPush, OpPop, OpCall, OpRet, OpRetf, OpInt, OpInt3, OpInto, OpIret,
+		OpPushf, OpPopf, OpLds, OpLes,
+		OpMovsw, OpCmpsw, OpScasw, OpLodsw, OpStosw:
+		return true
+	case OpMovsb, OpCmpsb, OpScasb, OpLodsb, OpStosb, OpXlat:
+		return false
+	}
+	for _, o := range in.Operands() {
+		if isWordOperand(o) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the address used to decide whether the memory transfers of the
+// instruction are at an odd address: the memory operand if there is one,
+// otherwise the stack or the string source or destination.
+func transferAddress(in Instruction, regs *Registers) int {
+	if d, ok := in.memOperand(); ok {
+		return int(dispOffset(regs, d))
+	}
+	switch in.Op {
+	case OpMovsb, OpMovsw, OpCmpsb, OpCmpsw, OpLodsb, OpLodsw:
+		return int(regs[RegSi])
+	case OpScasb, OpScasw, OpStosb, OpStosw:
+		return int(regs[RegDi])
+	}
+	return int(regs[RegSp])
+}
@@ -0,0 +1,409 @@
+package sim8086
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const debugHelp = `Commands:
+  step [n]          s  Execute n instructions (default 1) and trace them
+  continue          c  Run until a breakpoint is hit or the program halts
+  step-back [n]     sb Undo n instructions (default 1)
+  reverse-continue  rc Undo instructions until a breakpoint or watchpoint
+  goto n               Step forward or back to instruction number n
+  break [addr]      b  Set a breakpoint, or list the breakpoints
+  delete addr       d  Delete a breakpoint
+  regs              r  Show the registers and flags
+  dump addr [n]     x  Dump n bytes of memory (default 64)
+  set reg value        Set a register, or the flags by value or letters
+  write addr b...   w  Write bytes to memory
+  watch mode addr [n] [log]
+                       Watch n bytes (default 1) for reads (r), writes (w)
+                       or both (rw), halting unless log is given
+  unwatch              Delete all watchpoints
+  save file            Save a snapshot of the machine, see -load-state
+  help              h  Show this help
+  quit              q  Quit the debugger
+
+Addresses are seg:offset, an offset into cs for breakpoints and into ds
+otherwise, or a label as printed by -labels. Segments and offsets can be
+numbers, decimal unless prefixed with 0x, or registers. An empty line
+repeats the last command.
+`
+
+var ErrBadCommand = errors.New("bad command")
+
+type debugger struct {
+	m *Machine
+	w io.Writer
+	// Physical addresses of the labels of the program.
+	labels      map[string]int
+	breakpoints map[int]bool
+}
+
+// Debug runs an interactive debugger on the machine, reading commands from r
+// and writing to w. The program buf that was loaded into the machine
+// provides the labels that breakpoints can be set on, relative to where
+// execution starts. The machine records a journal from here on, so that
+// execution can be reversed.
+func Debug(r io.Reader, w io.Writer, m *Machine, buf []byte) error {
+	m.opts.Record = true
+	d := &debugger{m: m, w: w, labels: make(map[string]int), breakpoints: make(map[int]bool)}
+	start := Physical(m.Regs[RegCs], m.Regs[RegIp])
+	for offset, label := range jumpLabels(decodeLines(buf), len(buf)) {
+		d.labels[label] = start + offset
+	}
+	d.where()
+	scanner := bufio.NewScanner(r)
+	var last []string
+	for {
+		fmt.Fprint(w, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(w)
+			return scanner.Err()
+		}
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			args = last
+		}
+		if len(args) == 0 {
+			continue
+		}
+		last = args
+		if args[0] == "quit" || args[0] == "q" {
+			return nil
+		}
+		if err := d.command(args[0], args[1:]); err != nil {
+			fmt.Fprintf(w, "error: %v\n", err)
+		}
+	}
+}
+
+func (d *debugger) command(cmd string, args []string) error {
+	switch cmd {
+	case "step", "s":
+		n, err := count(args)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			step, err := d.m.Step()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(d.w, step)
+			if d.m.Halted {
+				fmt.Fprintln(d.w, haltReason(step))
+				break
+			}
+		}
+		d.where()
+	case "continue", "c":
+		for first := true; first || !d.breakpoints[d.ip()]; first = false {
+			step, err := d.m.Step()
+			if err != nil {
+				return err
+			}
+			for _, h := range step.Hits {
+				fmt.Fprintln(d.w, h)
+			}
+			if d.m.Halted {
+				fmt.Fprintln(d.w, haltReason(step))
+				break
+			}
+		}
+		if d.breakpoints[d.ip()] {
+			fmt.Fprintln(d.w, "breakpoint hit")
+		}
+		d.where()
+	case "step-back", "sb":
+		n, err := count(args)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if !d.m.StepBack() {
+				fmt.Fprintln(d.w, "start of journal")
+				break
+			}
+		}
+		d.where()
+	case "reverse-continue", "rc":
+		hits, ok := d.m.ReverseContinue(d.breakpoints)
+		for _, h := range hits {
+			fmt.Fprintln(d.w, h)
+		}
+		switch {
+		case !ok:
+			fmt.Fprintln(d.w, "start of journal")
+		case len(hits) > 0:
+			fmt.Fprintln(d.w, "watchpoint hit")
+		default:
+			fmt.Fprintln(d.w, "breakpoint hit")
+		}
+		d.where()
+	case "goto":
+		if len(args) != 1 {
+			return fmt.Errorf("%w: goto takes an instruction number", ErrBadCommand)
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return fmt.Errorf("%w: invalid instruction number %q", ErrBadCommand, args[0])
+		}
+		err = d.m.Goto(n)
+		d.where()
+		return err
+	case "break", "b":
+		if len(args) == 0 {
+			addrs := make([]int, 0, len(d.breakpoints))
+			for addr := range d.breakpoints {
+				addrs = append(addrs, addr)
+			}
+			sort.Ints(addrs)
+			for _, addr := range addrs {
+				fmt.Fprintf(d.w, "0x%05x\n", addr)
+			}
+			return nil
+		}
+		addr, err := d.address(args[0], RegCs)
+		if err != nil {
+			return err
+		}
+		d.breakpoints[addr] = true
+	case "delete", "d":
+		if len(args) != 1 {
+			return fmt.Errorf("%w: delete takes an address", ErrBadCommand)
+		}
+		addr, err := d.address(args[0], RegCs)
+		if err != nil {
+			return err
+		}
+		if !d.breakpoints[addr] {
+			return fmt.Errorf("no breakpoint at 0x%05x", addr)
+		}
+		delete(d.breakpoints, addr)
+	case "regs", "r":
+		fmt.Fprint(d.w, d.m.Regs.String())
+	case "dump", "x":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("%w: dump takes an address and a length", ErrBadCommand)
+		}
+		addr, err := d.address(args[0], RegDs)
+		if err != nil {
+			return err
+		}
+		n := 64
+		if len(args) > 1 {
+			v, err := strconv.ParseUint(args[1], 0, 20)
+			if err != nil {
+				return fmt.Errorf("%w: invalid length %q", ErrBadCommand, args[1])
+			}
+			n = int(v)
+		}
+		d.dump(addr, n)
+	case "set":
+		if len(args) != 2 {
+			return fmt.Errorf("%w: set takes a register and a value", ErrBadCommand)
+		}
+		return d.set(args[0], args[1])
+	case "write", "w":
+		if len(args) < 2 {
+			return fmt.Errorf("%w: write takes an address and bytes", ErrBadCommand)
+		}
+		addr, err := d.address(args[0], RegDs)
+		if err != nil {
+			return err
+		}
+		for i, arg := range args[1:] {
+			v, err := strconv.ParseUint(arg, 0, 8)
+			if err != nil {
+				return fmt.Errorf("%w: invalid byte %q", ErrBadCommand, arg)
+			}
+			d.m.Mem[(addr+i)%len(d.m.Mem)] = byte(v)
+		}
+	case "watch":
+		if len(args) < 2 || len(args) > 4 {
+			return fmt.Errorf("%w: watch takes a mode, an address and a length", ErrBadCommand)
+		}
+		addr, err := d.address(args[1], RegDs)
+		if err != nil {
+			return err
+		}
+		wp, err := ParseWatchpoint(fmt.Sprintf("%s:%d", args[0], addr))
+		if err != nil {
+			return err
+		}
+		wp.Halt = true
+		for _, arg := range args[2:] {
+			if arg == "log" {
+				wp.Halt = false
+				continue
+			}
+			n, err := strconv.ParseUint(arg, 0, 20)
+			if err != nil || n == 0 {
+				return fmt.Errorf("%w: invalid length %q", ErrBadCommand, arg)
+			}
+			wp.End = wp.Start + int(n)
+		}
+		d.m.opts.Watchpoints = append(d.m.opts.Watchpoints, wp)
+	case "unwatch":
+		d.m.opts.Watchpoints = nil
+	case "save":
+		if len(args) != 1 {
+			return fmt.Errorf("%w: save takes a file name", ErrBadCommand)
+		}
+		if err := d.m.SaveStateFile(args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(d.w, "saved state to %s\n", args[0])
+	case "help", "h":
+		fmt.Fprint(d.w, debugHelp)
+	default:
+		return fmt.Errorf("%w: unknown command %q, try help", ErrBadCommand, cmd)
+	}
+	return nil
+}
+
+// Parses the optional repeat count of a command.
+func count(args []string) (int, error) {
+	if len(args) == 0 {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%w: invalid count %q", ErrBadCommand, args[0])
+	}
+	return n, nil
+}
+
+// Returns why the machine halted after the step.
+func haltReason(step Step) string {
+	for _, h := range step.Hits {
+		if h.Watchpoint.Halt {
+			return "watchpoint hit"
+		}
+	}
+	return "program halted"
+}
+
+// Returns the physical address of cs:ip.
+func (d *debugger) ip() int {
+	return Physical(d.m.Regs[RegCs], d.m.Regs[RegIp])
+}
+
+// Prints the instruction at cs:ip, along with its number.
+func (d *debugger) where() {
+	cs, ip := d.m.Regs[RegCs], d.m.Regs[RegIp]
+	in, _, err := fetch(d.m.Mem, cs, ip, d.m.opts.lookup)
+	if err != nil {
+		fmt.Fprintf(d.w, "=> #%d %04x:%04x %v\n", d.m.Executed, cs, ip, err)
+		return
+	}
+	fmt.Fprintf(d.w, "=> #%d %04x:%04x %s\n", d.m.Executed, cs, ip, in)
+}
+
+// Prints n bytes of memory starting at the physical address, 16 to a line.
+func (d *debugger) dump(addr, n int) {
+	for i := 0; i < n; i += 16 {
+		fmt.Fprintf(d.w, "%05x:", (addr+i)%len(d.m.Mem))
+		for j := i; j < i+16 && j < n; j++ {
+			fmt.Fprintf(d.w, " %02x", d.m.Mem[(addr+j)%len(d.m.Mem)])
+		}
+		fmt.Fprintln(d.w)
+	}
+}
+
+func (d *debugger) set(name, value string) error {
+	if name == "flags" {
+		flags, err := parseFlags(value)
+		if err != nil {
+			return err
+		}
+		d.m.Regs[RegFlags] = flags
+		return nil
+	}
+	reg, ok := parseRegister(name)
+	if !ok {
+		return fmt.Errorf("%w: unknown register %q", ErrBadCommand, name)
+	}
+	v, err := d.value(value)
+	if err != nil {
+		return err
+	}
+	store(&d.m.Regs, d.m.Mem, unsized(reg), v, reg.Width == WidthFull)
+	return nil
+}
+
+// Returns the physical address of a label or of seg:offset, where the
+// segment defaults to the given segment register.
+func (d *debugger) address(s string, seg Register) (int, error) {
+	if addr, ok := d.labels[s]; ok {
+		return addr, nil
+	}
+	segment := d.m.Regs[seg]
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		v, err := d.value(s[:i])
+		if err != nil {
+			return 0, err
+		}
+		segment, s = v, s[i+1:]
+	}
+	offset, err := d.value(s)
+	if err != nil {
+		return 0, err
+	}
+	return Physical(segment, offset), nil
+}
+
+// Parses a number or the name of a register, whose value is returned.
+func (d *debugger) value(s string) (uint16, error) {
+	if reg, ok := parseRegister(s); ok {
+		return load(&d.m.Regs, d.m.Mem, unsized(reg), reg.Width == WidthFull), nil
+	}
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid value %q", ErrBadCommand, s)
+	}
+	return uint16(v), nil
+}
+
+func parseRegister(s string) (OperandReg, bool) {
+	for r := RegAx; r < RegFlags; r++ {
+		for _, width := range []RegisterWidth{WidthFull, WidthLo, WidthHi} {
+			if name := regStrsFull[r][width]; name != "" && name == s {
+				return OperandReg{r, width}, true
+			}
+		}
+	}
+	return OperandReg{}, false
+}
+
+// Parses flags given as a number or as letters, such as CZ. A single - clears
+// all flags.
+func parseFlags(s string) (Flags, error) {
+	if v, err := strconv.ParseUint(s, 0, 16); err == nil {
+		return Flags(v) & allFlags, nil
+	}
+	var flags Flags
+	if s == "-" {
+		return flags, nil
+	}
+	for _, c := range s {
+		found := false
+		for _, flag := range regFlags {
+			if FlagString(flag) == strings.ToUpper(string(c)) {
+				flags |= flag
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("%w: unknown flag %q", ErrBadCommand, c)
+		}
+	}
+	return flags, nil
+}
@@ -0,0 +1,364 @@
+package sim8086
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrTruncated       = errors.New("truncated instruction")
+	ErrUnknownOpcode   = errors.New("unknown opcode")
+	ErrIllegalEncoding = errors.New("illegal encoding")
+)
+
+// DecodeError records the offset of the instruction that could not be
+// decoded. The underlying error is one of ErrTruncated, ErrUnknownOpcode or
+// ErrIllegalEncoding.
+type DecodeError struct {
+	Offset int
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func DecodeInstruction(buf []byte, ip int) (in Instruction, advance int, err error) {
+	return decodeInstruction(buf, ip, nil)
+}
+
+// Decodes like DecodeInstruction, but looks operations up with lookup instead
+// of the opcode table if it is not nil. The benchmarks use it to compare the
+// table against the switch it was built from.
+func decodeInstruction(buf []byte, ip int, lookup func(b1, b2 byte) OpDescr) (in Instruction, advance int, err error) {
+	var prefix Prefix
+	start := ip
+	for ip < len(buf) && prefix.Add(buf[ip]) {
+		ip++
+	}
+	if ip >= len(buf) {
+		return in, 0, &DecodeError{start, ErrTruncated}
+	}
+	in, advance, err = decodeOperation(buf, ip, lookup)
+	if err != nil {
+		return in, 0, &DecodeError{start, err}
+	}
+	in.Prefix = prefix
+	if prefix.Seg != SegNone {
+		for i := range in.Operands() {
+			if in.operands[i].kind == operandDisp {
+				in.operands[i].disp.Seg = prefix.Seg
+			}
+		}
+	}
+	// Keep prefixes that are repeated or out of order, so that Encode can
+	// reproduce them.
+	var canon [4]byte
+	if raw := buf[start:ip]; string(raw) != string(prefix.appendTo(canon[:0])) {
+		in.form.prefixes = string(raw)
+	}
+	advance += ip - start
+	in.Size = advance
+	return in, advance, nil
+}
+
+// An entry of the opcode table. The opcodes whose ModRM REG field selects
+// the operation have a sub-table by REG instead.
+type opcodeEntry struct {
+	OpDescr
+	group *[8]OpDescr
+}
+
+// The operation of every opcode, built from operation so that decoding
+// takes a table lookup instead of a switch.
+var opcodes = func() (t [0x100]opcodeEntry) {
+	for b1 := range t {
+		var group [8]OpDescr
+		extended := false
+		for reg := range group {
+			group[reg] = operation(byte(b1), byte(reg)<<3)
+			extended = extended || group[reg] != group[0]
+		}
+		t[b1].OpDescr = group[0]
+		if extended {
+			t[b1].group = &group
+		}
+	}
+	return t
+}()
+
+// Returns the operation of the opcode b1 with the ModRM byte b2, like
+// operation.
+func lookupOperation(b1, b2 byte) OpDescr {
+	e := &opcodes[b1]
+	if e.group != nil {
+		return e.group[(b2>>3)&0b111]
+	}
+	return e.OpDescr
+}
+
+// The longest instruction, not counting prefixes, is six bytes: opcode,
+// ModRM, two bytes of displacement and two bytes of immediate.
+const maxInstructionLen = 6
+
+func decodeOperation(buf []byte, ip int, lookup func(b1, b2 byte) OpDescr) (in Instruction, advance int, err error) {
+	// Decode from a zero padded copy of the instruction bytes so that a
+	// truncated instruction can be detected from its length at the end,
+	// instead of bounds checking every read.
+	var window [maxInstructionLen]byte
+	n := copy(window[:], buf[ip:])
+	buf, ip = window[:], 0
+	b1, b2 := buf[ip], buf[ip+1]
+	// The table is looked up directly, calling through lookup would cost
+	// more than the lookup itself.
+	var o OpDescr
+	if lookup != nil {
+		o = lookup(b1, b2)
+	} else {
+		o = lookupOperation(b1, b2)
+	}
+	switch o.kind {
+	case KindRmToFromRm:
+		D, W := (b1>>1)&1, b1&1
+		MOD, REG, RM := b2>>6, (b2>>3)&0b111, b2&0b111
+		var dst, src Operand
+		dst, advance = RmOperand(buf, ip, MOD, RM, W)
+		src = unsized(register(REG, W))
+		if D == 1 {
+			dst, src = src, dst
+		}
+		in = NewInstruction(o.op, dst, src)
+	case KindImmToRm:
+		// Immediate to register/memory
+		S, W := (b1>>1)&1, b1&1
+		MOD, RM := b2>>6, b2&0b111
+		var dst, src Operand
+		var offset int
+		dst, offset = RmOperand(buf, ip, MOD, RM, W)
+		// It's kind of weird putting an explicit size on an immediate, but it is
+		// valid in the disassembly. It's just that it's also unnecessary since it
+		// can be inferred from the immediate and the other operand. Change
+		// src.size below between SizeNone and SizeFrom(W), either way the tests
+		// still pass.
+		// Only the arithmetic group (100000sw) has a sign extension bit, in the
+		// other encodings the bit is part of the opcode.
+		if b1>>2 == 0b100000 && S == 1 {
+			src = unsized(OperandSigned(buf[ip+offset : ip+offset+1]))
+			advance = offset + 1
+		} else {
+			src = unsized(OperandUnsigned(buf[ip+offset : ip+offset+1+int(W)]))
+			advance = offset + 1 + int(W)
+		}
+		in = NewInstruction(o.op, dst, src)
+	case KindMemToFromAcc:
+		// Memory/accumulator to acumulator/memory
+		D, W := (b1>>1)&1, b1&1
+		disp := OperandDisplacement{Kind: DispEA, Imm: OperandSigned(buf[ip+1 : ip+3])}
+		width := [...]RegisterWidth{WidthLo, WidthFull}[W]
+		reg := OperandReg{RegAx, width}
+		var dst, src OperandType
+		if D == 0 {
+			dst, src = reg, disp
+		} else {
+			dst, src = disp, reg
+		}
+		in = NewInstruction(o.op, unsized(dst), unsized(src))
+		advance = 3
+	case KindImmToReg:
+		// Immediate to register
+		W, REG := (b1>>3)&1, b1&0b111
+		dst := register(REG, W)
+		src := OperandSigned(buf[ip+1 : ip+2+int(W)])
+		in = NewInstruction(o.op, unsized(dst), unsized(src))
+		advance = 2 + int(W)
+	case KindImmToAcc:
+		// Immediate to accumulator
+		W := b1 & 1
+		width := [...]RegisterWidth{WidthLo, WidthFull}[W]
+		dst := OperandReg{RegAx, width}
+		src := OperandSigned(buf[ip+1 : ip+2+int(W)])
+		in = NewInstruction(o.op, unsized(dst), unsized(src))
+		advance = 2 + int(W)
+	case KindRmToSeg, KindSegToRm:
+		MOD, SR, RM := b2>>6, (b2>>3)&0b11, b2&0b111
+		if (b2>>5)&1 != 0 {
+			return in, 0, ErrIllegalEncoding
+		}
+		var dst, src Operand
+		dst, advance = RmOperand(buf, ip, MOD, RM, 1)
+		src = unsized(Segment(SR))
+		if o.kind == KindRmToSeg {
+			dst, src = src, dst
+		}
+		in = NewInstruction(o.op, dst, src)
+	case KindCondJmp:
+		ipInc := OperandSigned(buf[ip+1 : ip+2])
+		in = NewInstruction(o.op, unsized(ipInc))
+		advance = 2
+	case KindNone:
+		in = Instruction{Op: o.op}
+		advance = 1
+	case KindRm:
+		W := b1 & 1
+		MOD, REG, RM := b2>>6, (b2>>3)&0b111, b2&0b111
+		var dst Operand
+		dst, advance = RmOperand(buf, ip, MOD, RM, W)
+		// Intersegment call and jmp through memory load a full far pointer.
+		if (o.op == OpCall || o.op == OpJmp) && REG&1 == 1 {
+			if MOD == 0b11 {
+				return in, 0, ErrIllegalEncoding
+			}
+			dst.Size = SizeFar
+		}
+		in = NewInstruction(o.op, dst)
+	case KindReg:
+		dst := register(b1&0b111, 1)
+		in = NewInstruction(o.op, unsized(dst))
+		advance = 1
+	case KindAccReg:
+		dst := OperandReg{RegAx, WidthFull}
+		src := register(b1&0b111, 1)
+		in = NewInstruction(o.op, unsized(dst), unsized(src))
+		advance = 1
+	case KindSeg:
+		dst := Segment((b1 >> 3) & 0b11)
+		in = NewInstruction(o.op, unsized(dst))
+		advance = 1
+	case KindShift:
+		V, W := (b1>>1)&1, b1&1
+		MOD, RM := b2>>6, b2&0b111
+		var dst Operand
+		dst, advance = RmOperand(buf, ip, MOD, RM, W)
+		src := unsized(OperandImmU(1))
+		if V == 1 {
+			src = unsized(OperandReg{RegCx, WidthLo})
+		}
+		in = NewInstruction(o.op, dst, src)
+	case KindLoadAddr:
+		MOD, REG, RM := b2>>6, (b2>>3)&0b111, b2&0b111
+		if MOD == 0b11 {
+			return in, 0, ErrIllegalEncoding
+		}
+		var src Operand
+		src, advance = RmOperand(buf, ip, MOD, RM, 1)
+		// The memory operand only supplies an address, its size is implied.
+		src.Size = SizeNone
+		dst := unsized(register(REG, 1))
+		in = NewInstruction(o.op, dst, src)
+	case KindInOut:
+		// 1110v1dw where v selects a variable port in dx and d selects out.
+		V, D, W := (b1>>3)&1, (b1>>1)&1, b1&1
+		width := [...]RegisterWidth{WidthLo, WidthFull}[W]
+		acc := OperandReg{RegAx, width}
+		var port OperandType
+		if V == 1 {
+			port = OperandReg{RegDx, WidthFull}
+			advance = 1
+		} else {
+			port = OperandUnsigned(buf[ip+1 : ip+2])
+			advance = 2
+		}
+		if D == 0 {
+			in = NewInstruction(o.op, unsized(acc), unsized(port))
+		} else {
+			in = NewInstruction(o.op, unsized(port), unsized(acc))
+		}
+	case KindNearJmp:
+		ipInc := unsized(OperandSigned(buf[ip+1 : ip+3]))
+		// Without the explicit near, the assembler is free to pick the short
+		// jump encoding.
+		if o.op == OpJmp {
+			ipInc.Size = SizeNear
+		}
+		in = NewInstruction(o.op, ipInc)
+		advance = 3
+	case KindFarJmp:
+		offset := OperandUnsigned(buf[ip+1 : ip+3])
+		seg := OperandUnsigned(buf[ip+3 : ip+5])
+		dst := OperandFarPtr{uint16(seg), uint16(offset)}
+		in = NewInstruction(o.op, unsized(dst))
+		advance = 5
+	case KindImm8:
+		imm := OperandUnsigned(buf[ip+1 : ip+2])
+		in = NewInstruction(o.op, unsized(imm))
+		advance = 2
+	case KindImm16:
+		imm := OperandUnsigned(buf[ip+1 : ip+3])
+		in = NewInstruction(o.op, unsized(imm))
+		advance = 3
+	case KindAsciiAdjust:
+		// The second byte is the number base, which is always 10 unless
+		// specified otherwise.
+		in = Instruction{Op: o.op}
+		if b2 != 10 {
+			in.SetOperands(unsized(OperandImmU(b2)))
+		}
+		advance = 2
+	case KindUnknown:
+		return in, 0, fmt.Errorf("%w %08b %08b", ErrUnknownOpcode, b1, b2)
+	default:
+		panic(o)
+	}
+	if advance == 0 {
+		panic("instruction stream did not advance")
+	}
+	if advance > n {
+		return in, 0, ErrTruncated
+	}
+	in.Kind = o.kind
+	in.Size = advance
+	in.form = encodingForm{
+		decoded:    true,
+		dir:        b1&0b10 != 0,
+		signExtend: b1>>2 == 0b100000 && b1&0b10 != 0,
+		reg:        (b2 >> 3) & 0b111,
+		dispLen:    dispLen(b2>>6, b2&0b111),
+	}
+	return in, advance, nil
+}
+
+// Returns the number of bytes of displacement that follow a ModRM byte.
+func dispLen(MOD, RM byte) int {
+	switch {
+	case MOD == 0b00 && RM == 0b110, MOD == 0b10:
+		return 2
+	case MOD == 0b01:
+		return 1
+	}
+	return 0
+}
+
+func RmOperand(buf []byte, ip int, MOD, RM, W byte) (Operand, int) {
+	if MOD == 0b11 {
+		// Register to register
+		return unsized(register(RM, W)), 2
+	}
+	var advance int
+	var disp OperandDisplacement
+	disp.Kind = DisplacementKind(RM)
+	switch MOD {
+	case 0b00:
+		if RM == 0b110 {
+			// Memory-mode, direct address
+			disp.Kind = DispEA
+			disp.Imm = OperandImm(OperandUnsigned(buf[ip+2 : ip+4]))
+			advance = 4
+		} else {
+			// Memory-mode, no displacement
+			advance = 2
+		}
+	case 0b01:
+		// Memory-mode with 8-bit displacement
+		disp.Imm = OperandSigned(buf[ip+2 : ip+3])
+		advance = 3
+	case 0b10:
+		// Memory-mode with 16-bit displacement
+		disp.Imm = OperandSigned(buf[ip+2 : ip+4])
+		advance = 4
+	}
+	return NewOperand(SizeFrom(W), disp), advance
+}
@@ -0,0 +1,207 @@
+package sim8086
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+type DisasmOptions struct {
+	// Print the targets of relative jumps, loops and calls as labels instead
+	// of as offsets relative to the instruction.
+	Labels bool
+	// Only decode the instructions that are reached from the start by
+	// following jumps, calls and fallthrough, so that data between code is
+	// not decoded as instructions. The bytes that are not reached are
+	// written out as data.
+	Recursive bool
+}
+
+// A line of disassembly: either an instruction or a run of bytes that could
+// not be decoded, or that were not reached in recursive disassembly.
+type disasmLine struct {
+	ip   int
+	in   Instruction
+	data []byte
+}
+
+// Disassemble writes out the NASM syntax disassembly of buf. Bytes that do
+// not decode to an instruction are written out as data and decoding resumes
+// at the next byte.
+func Disassemble(w io.Writer, buf []byte, opts DisasmOptions) {
+	var lines []disasmLine
+	if opts.Recursive {
+		lines = traceLines(buf)
+	} else {
+		lines = decodeLines(buf)
+	}
+	labels := make(map[int]string)
+	if opts.Labels {
+		labels = jumpLabels(lines, len(buf))
+	}
+	fmt.Fprintln(w, "bits 16")
+	fmt.Fprintln(w)
+	for _, l := range lines {
+		if label, ok := labels[l.ip]; ok {
+			fmt.Fprintf(w, "%s:\n", label)
+		}
+		switch {
+		case l.data != nil:
+			fmt.Fprintln(w, dataString(l.data))
+		case l.in.IsRelJump() && labels[l.in.Target(l.ip)] != "":
+			fmt.Fprintln(w, l.in.WithLabel(labels[l.in.Target(l.ip)]))
+		default:
+			fmt.Fprintln(w, l.in)
+		}
+	}
+	if label, ok := labels[len(buf)]; ok {
+		fmt.Fprintf(w, "%s:\n", label)
+	}
+}
+
+// Returns the labels of the targets of relative jumps, by offset. Labels can
+// only be placed at the start of a line or at the end, jumps to anywhere else
+// keep their relative offset.
+func jumpLabels(lines []disasmLine, end int) map[int]string {
+	labels := make(map[int]string)
+	starts := make(map[int]bool, len(lines)+1)
+	for _, l := range lines {
+		starts[l.ip] = true
+	}
+	starts[end] = true
+	for _, l := range lines {
+		if l.data == nil && l.in.IsRelJump() {
+			if target := l.in.Target(l.ip); starts[target] {
+				labels[target] = labelName(target)
+			}
+		}
+	}
+	return labels
+}
+
+// Decodes buf linearly from the start. Consecutive bytes that can not be
+// decoded are collected into a single data line.
+func decodeLines(buf []byte) []disasmLine {
+	var lines []disasmLine
+	for ip := 0; ip < len(buf); {
+		in, advance, err := DecodeInstruction(buf, ip)
+		if err != nil {
+			if n := len(lines); n > 0 && lines[n-1].data != nil {
+				lines[n-1].data = append(lines[n-1].data, buf[ip])
+			} else {
+				lines = append(lines, disasmLine{ip: ip, data: []byte{buf[ip]}})
+			}
+			ip++
+			continue
+		}
+		lines = append(lines, disasmLine{ip: ip, in: in})
+		ip += advance
+	}
+	return lines
+}
+
+// Decodes the instructions of buf that are reached from the start by
+// following jumps, calls and fallthrough. The runs of bytes in between are
+// collected into data lines. A path is not followed into bytes that do not
+// decode, or that overlap an instruction that was already decoded.
+func traceLines(buf []byte) []disasmLine {
+	code := make([]bool, len(buf))
+	decoded := make(map[int]Instruction)
+	for work := []int{0}; len(work) > 0; {
+		ip := work[len(work)-1]
+		work = work[:len(work)-1]
+		var prev Instruction
+		for ip >= 0 && ip < len(buf) {
+			if _, ok := decoded[ip]; ok {
+				break
+			}
+			in, advance, err := DecodeInstruction(buf, ip)
+			if err != nil || slices.Contains(code[ip:ip+advance], true) {
+				break
+			}
+			for i := ip; i < ip+advance; i++ {
+				code[i] = true
+			}
+			decoded[ip] = in
+			if in.IsRelJump() {
+				work = append(work, in.Target(ip))
+			}
+			if !continuesAfter(in, prev) {
+				break
+			}
+			prev = in
+			ip += advance
+		}
+	}
+	var lines []disasmLine
+	for ip := 0; ip < len(buf); {
+		if in, ok := decoded[ip]; ok {
+			lines = append(lines, disasmLine{ip: ip, in: in})
+			ip += in.Size
+			continue
+		}
+		start := ip
+		for ip < len(buf) && !code[ip] {
+			ip++
+		}
+		lines = append(lines, disasmLine{ip: start, data: buf[start:ip]})
+	}
+	return lines
+}
+
+// Reports whether execution can continue with the instruction after in,
+// which comes after prev. Besides jumps and returns, that is not the case
+// for hlt and for the DOS calls that end the program.
+func continuesAfter(in, prev Instruction) bool {
+	if _, fallsThrough := endsBlock(in); !fallsThrough {
+		return false
+	}
+	switch in.Op {
+	case OpHlt:
+		return false
+	case OpInt:
+		switch immValue(in.Operands()[0].Op()) {
+		case 0x20:
+			return false
+		case 0x21:
+			// Functions 00h and 4ch terminate the program.
+			ah, ok := movedToAh(prev)
+			return !ok || ah != 0x00 && ah != 0x4c
+		}
+	}
+	return true
+}
+
+// Returns the value that the instruction sets ah to, if it is a mov of an
+// immediate to ah or ax.
+func movedToAh(in Instruction) (byte, bool) {
+	if in.Op != OpMov || len(in.Operands()) != 2 || !isImmediate(in.Operands()[1]) {
+		return 0, false
+	}
+	v := immValue(in.Operands()[1].Op())
+	switch in.Operands()[0].Op() {
+	case OperandReg{RegAx, WidthHi}:
+		return byte(v), true
+	case OperandReg{RegAx, WidthFull}:
+		return byte(v >> 8), true
+	}
+	return 0, false
+}
+
+func labelName(ip int) string {
+	return fmt.Sprintf("label_%04x", ip)
+}
+
+// Returns a db directive for the given bytes.
+func dataString(bb []byte) string {
+	var sb strings.Builder
+	sb.WriteString("db ")
+	for i, b := range bb {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "0x%02x", b)
+	}
+	return sb.String()
+}
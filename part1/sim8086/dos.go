@@ -0,0 +1,113 @@
+package sim8086
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// InterruptHandler services a software interrupt in place of the handler
+// in the interrupt vector table. Returning ErrExit ends the simulation.
+type InterruptHandler func(regs *Registers, mem *Memory) error
+
+// Interrupts maps interrupt numbers to their handlers. Interrupts without a
+// handler go through the interrupt vector table.
+type Interrupts map[uint8]InterruptHandler
+
+var (
+	ErrExit               = errors.New("program exited")
+	ErrUnsupportedService = errors.New("unsupported service")
+	ErrImageTooLarge      = errors.New("image too large")
+)
+
+const (
+	// The segment .COM programs are loaded at, as if DOS had allocated it.
+	comSegment = 0x1000
+	// Programs start right after the 256 byte program segment prefix.
+	pspSize = 0x100
+	// A program has a whole segment, but needs room for the initial stack.
+	maxCOMSize = 0x10000 - pspSize - 2
+)
+
+// LoadCOM places the image of a .COM program at seg:0100, after a minimal
+// program segment prefix, and returns the registers the program starts with.
+// All segment registers point at the PSP and the stack is at the end of the
+// segment, with a zero word on top so that ret jumps to the int 20h at the
+// start of the PSP.
+func LoadCOM(mem *Memory, image []byte, seg uint16) (Registers, error) {
+	var regs Registers
+	if len(image) > maxCOMSize {
+		return regs, fmt.Errorf("%w: %d bytes", ErrImageTooLarge, len(image))
+	}
+	mem.Write(seg, 0x00, 0x20cd, true) // int 20h
+	mem.Write(seg, 0x02, 0xa000, true) // First segment after the program's memory
+	mem.Write(seg, 0x80, 0, false)     // Empty command line
+	mem.Write(seg, 0x81, '\r', false)
+	for i, b := range image {
+		mem.Write(seg, uint16(pspSize+i), uint16(b), false)
+	}
+	regs[RegCs], regs[RegDs], regs[RegEs], regs[RegSs] = seg, seg, seg, seg
+	regs[RegIp] = pspSize
+	regs[RegSp] = 0xfffe
+	mem.Write(seg, regs[RegSp], 0, true)
+	return regs, nil
+}
+
+// DOSServices returns stub implementations of the DOS and BIOS services most
+// commonly used by small .COM programs. Character output is written to out.
+//
+//	int 10h ah=0eh: Teletype output of al
+//	int 20h:        Terminate program
+//	int 21h ah=02h: Write character in dl
+//	int 21h ah=09h: Write string at ds:dx, terminated by '$'
+//	int 21h ah=4ch: Terminate program with return code in al
+func DOSServices(out io.Writer) Interrupts {
+	return Interrupts{
+		0x10: func(regs *Registers, mem *Memory) error {
+			return videoService(out, regs)
+		},
+		0x20: func(regs *Registers, mem *Memory) error {
+			return ErrExit
+		},
+		0x21: func(regs *Registers, mem *Memory) error {
+			return dosService(out, regs, mem)
+		},
+	}
+}
+
+func videoService(out io.Writer, regs *Registers) error {
+	switch ah := regs[RegAx] >> 8; ah {
+	case 0x0e:
+		_, err := out.Write([]byte{byte(regs[RegAx])})
+		return err
+	default:
+		return fmt.Errorf("%w: int 10h ah=%02xh", ErrUnsupportedService, ah)
+	}
+}
+
+func dosService(out io.Writer, regs *Registers, mem *Memory) error {
+	switch ah := regs[RegAx] >> 8; ah {
+	case 0x02:
+		// Al is set to the character written.
+		dl := regs[RegDx] & 0xff
+		regs[RegAx] = regs[RegAx]&0xff00 | dl
+		_, err := out.Write([]byte{byte(dl)})
+		return err
+	case 0x09:
+		var s []byte
+		for offset := regs[RegDx]; len(s) < 0x10000; offset++ {
+			c := byte(mem.Read(regs[RegDs], offset, false))
+			if c == '$' {
+				break
+			}
+			s = append(s, c)
+		}
+		regs[RegAx] = regs[RegAx]&0xff00 | '$'
+		_, err := out.Write(s)
+		return err
+	case 0x4c:
+		return ErrExit
+	default:
+		return fmt.Errorf("%w: int 21h ah=%02xh", ErrUnsupportedService, ah)
+	}
+}
@@ -0,0 +1,607 @@
+package sim8086
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidOperands = errors.New("invalid combination of operands")
+
+// The opcode and ModRM REG field that an operation is encoded with.
+type encoding struct {
+	opcode, reg byte
+}
+
+// Encodings of every operation the decoder knows, by the lowest opcode and
+// REG field that decode to it. For the opcodes with direction, width or
+// sign bits, these are all clear. Searching the decoder's table means that
+// the encoder and the decoder can not disagree.
+var encodings = func() map[OpDescr]encoding {
+	m := make(map[OpDescr]encoding)
+	for b1 := 0; b1 < 0x100; b1++ {
+		for reg := byte(0); reg < 8; reg++ {
+			o := operation(byte(b1), reg<<3)
+			if _, ok := m[o]; !ok && o.kind != KindUnknown {
+				m[o] = encoding{byte(b1), reg}
+			}
+		}
+	}
+	return m
+}()
+
+// The choices made in encoding an instruction that has more than one
+// encoding. DecodeInstruction records them so that Encode reproduces the
+// original bytes. Without them, Encode picks the encoding NASM would.
+type encodingForm struct {
+	decoded bool
+	// D bit of register/memory to/from register: REG is the destination.
+	dir bool
+	// S bit of immediate to register/memory: a byte immediate is sign
+	// extended.
+	signExtend bool
+	// REG field of the ModRM byte, where it extends the opcode.
+	reg byte
+	// Bytes of displacement of a memory operand.
+	dispLen int
+	// The prefix bytes, when they are not the ones Encode would write.
+	prefixes string
+}
+
+// Encode returns the machine code of the instruction. The operand of a
+// relative jump is relative to the end of the instruction, as returned by
+// DecodeInstruction. A decoded instruction encodes to the bytes it was
+// decoded from. Otherwise, where there is a choice of encodings, the
+// shortest one is picked the way NASM does, so that the instructions of a
+// program assembled by NASM encode to the original bytes.
+//
+// Encode panics if the instruction can not be encoded. That can not happen
+// for instructions returned by DecodeInstruction.
+func Encode(in Instruction) []byte {
+	code, err := encode(in)
+	if err != nil {
+		panic(fmt.Sprintf("Encode %s: %v", in, err))
+	}
+	return code
+}
+
+func encode(in Instruction) ([]byte, error) {
+	kind := in.Kind
+	if !in.form.decoded {
+		var err error
+		if in, kind, err = chooseForm(in); err != nil {
+			return nil, err
+		}
+	}
+	code := []byte(in.form.prefixes)
+	if in.form.prefixes == "" {
+		seg := in.Prefix.Seg
+		if d, ok := in.memOperand(); ok && d.Seg != SegNone {
+			seg = d.Seg
+		}
+		code = Prefix{in.Prefix.Lock, in.Prefix.Rep, seg}.appendTo(code)
+	}
+	return encodeAs(code, in, kind)
+}
+
+// Returns the bytes of the prefixes appended to code.
+func (p Prefix) appendTo(code []byte) []byte {
+	if p.Lock {
+		code = append(code, 0b11110000)
+	}
+	switch p.Rep {
+	case Rep:
+		code = append(code, 0b11110011)
+	case Repne:
+		code = append(code, 0b11110010)
+	}
+	if p.Seg != SegNone {
+		// Segment override is encoded as 001sr110.
+		code = append(code, 0b00100110|byte(p.Seg-1)<<3)
+	}
+	return code
+}
+
+// Picks the encoding of an instruction that was not decoded, the way NASM
+// does. The operands of xchg and test are put in the order that encoding
+// expects.
+func chooseForm(in Instruction) (Instruction, OpKind, error) {
+	ops := in.Operands()
+	has := func(kind OpKind) bool {
+		_, ok := encodings[OpDescr{kind, in.Op}]
+		return ok
+	}
+	switch len(ops) {
+	case 0:
+		if in.Op == OpAam || in.Op == OpAad {
+			return in, KindAsciiAdjust, nil
+		}
+		return in, KindNone, nil
+	case 1:
+		o := ops[0]
+		switch op := o.Op().(type) {
+		case OperandImm, OperandImmU:
+			switch {
+			case in.IsRelJump() && (in.Op == OpCall || o.Size == SizeNear):
+				return in, KindNearJmp, nil
+			case in.IsRelJump():
+				return in, KindCondJmp, nil
+			case in.Op == OpRet || in.Op == OpRetf:
+				return in, KindImm16, nil
+			case in.Op == OpAam || in.Op == OpAad:
+				return in, KindAsciiAdjust, nil
+			}
+			return in, KindImm8, nil
+		case OperandFarPtr:
+			return in, KindFarJmp, nil
+		case OperandReg:
+			if _, ok := segmentCode(op); ok {
+				return in, KindSeg, nil
+			}
+			if _, w, ok := registerCode(op); ok && w == 1 && has(KindReg) {
+				return in, KindReg, nil
+			}
+		}
+		return in, KindRm, nil
+	case 2:
+	default:
+		return in, KindUnknown, fmt.Errorf("%w for %s", ErrInvalidOperands, in.Op)
+	}
+
+	dst, src := ops[0], ops[1]
+	_, dstIsSeg := segmentCode(dst.Op())
+	_, srcIsSeg := segmentCode(src.Op())
+	_, _, srcIsReg := registerCode(src.Op())
+	switch in.Op {
+	case OpMov:
+		_, _, dstIsReg := registerCode(dst.Op())
+		_, dstIsAcc := accumulator(dst)
+		_, srcIsAcc := accumulator(src)
+		switch {
+		case dstIsSeg:
+			return in, KindRmToSeg, nil
+		case srcIsSeg:
+			return in, KindSegToRm, nil
+		case dstIsAcc && isDirect(src) || srcIsAcc && isDirect(dst):
+			return in, KindMemToFromAcc, nil
+		case dstIsReg && isImmediate(src):
+			return in, KindImmToReg, nil
+		}
+	case OpXchg:
+		if _, ok := wordRegisterWith(dst, src, RegAx); ok {
+			return in, KindAccReg, nil
+		}
+		// The opcode has the direction bit set, the register goes into the
+		// REG field.
+		if _, _, ok := registerCode(dst.Op()); !ok {
+			dst, src = src, dst
+		}
+		in.SetOperands(dst, src)
+		in.form.dir = true
+		return in, KindRmToFromRm, nil
+	case OpIn, OpOut:
+		return in, KindInOut, nil
+	case OpLea, OpLds, OpLes:
+		return in, KindLoadAddr, nil
+	}
+	if has(KindShift) {
+		return in, KindShift, nil
+	}
+	if isImmediate(src) {
+		w, known, err := operandWidths(in.Op, dst, src)
+		if err == nil && !known {
+			err = fmt.Errorf("%w for %s: operation size not specified", ErrInvalidOperands, in.Op)
+		}
+		// The arithmetic group can sign extend a byte to a word, which is
+		// shorter even than the accumulator encoding.
+		alu := encodings[OpDescr{KindImmToRm, in.Op}].opcode == 0b10000000
+		in.form.signExtend = alu && w == 1 && fitsSigned8(immValue(src.Op()))
+		if _, ok := accumulator(dst); ok && !in.form.signExtend && has(KindImmToAcc) {
+			return in, KindImmToAcc, err
+		}
+		return in, KindImmToRm, err
+	}
+	// Test has no direction bit, the register always goes into the REG
+	// field. Otherwise NASM puts the source there, unless it is memory.
+	if in.Op == OpTest && !srcIsReg {
+		in.SetOperands(src, dst)
+	} else {
+		in.form.dir = !srcIsReg
+	}
+	return in, KindRmToFromRm, nil
+}
+
+// Appends the encoding of the instruction, without prefixes, as the given
+// kind of operation to code.
+func encodeAs(code []byte, in Instruction, kind OpKind) ([]byte, error) {
+	invalid := fmt.Errorf("%w for %s", ErrInvalidOperands, in.Op)
+	e, ok := encodings[OpDescr{kind, in.Op}]
+	if !ok {
+		return nil, invalid
+	}
+	f := in.form
+	ext := e.reg
+	if f.decoded {
+		ext = f.reg
+	}
+	ops := in.Operands()
+	var dst, src Operand
+	switch len(ops) {
+	case 2:
+		dst, src = ops[0], ops[1]
+	case 1:
+		dst = ops[0]
+	}
+	one := len(ops) == 1
+	two := len(ops) == 2
+	switch kind {
+	case KindRmToFromRm:
+		rm, reg, d := dst, src, byte(0)
+		if f.dir {
+			rm, reg, d = src, dst, 0b10
+		}
+		rc, w, ok := registerCode(reg.Op())
+		if !two || !ok {
+			return nil, invalid
+		}
+		if _, _, err := operandWidths(in.Op, rm, reg); err != nil {
+			return nil, err
+		}
+		return appendModRM(append(code, e.opcode&^0b10|d|w), rm, rc, f)
+	case KindImmToRm:
+		w, known, err := operandWidths(in.Op, dst, src)
+		switch {
+		case err != nil:
+			return nil, err
+		case !two || !isImmediate(src) || isImmediate(dst):
+			return nil, invalid
+		case !known:
+			return nil, fmt.Errorf("%w: operation size not specified", invalid)
+		}
+		opcode := e.opcode | w
+		v := immValue(src.Op())
+		if f.signExtend {
+			// Only the arithmetic group has a sign extension bit.
+			if e.opcode != 0b10000000 || w == 1 && !fitsSigned8(v) {
+				return nil, invalid
+			}
+			opcode |= 0b10
+			w = 0
+		}
+		code, err = appendModRM(append(code, opcode), dst, ext, f)
+		if err != nil {
+			return nil, err
+		}
+		return appendImm(code, v, w)
+	case KindMemToFromAcc:
+		acc, mem, d := dst, src, byte(0)
+		if isDirect(dst) {
+			acc, mem, d = src, dst, 0b10
+		}
+		w, ok := accumulator(acc)
+		if !two || !ok || !isDirect(mem) {
+			return nil, invalid
+		}
+		if _, _, err := operandWidths(in.Op, acc, mem); err != nil {
+			return nil, err
+		}
+		disp := uint16(mem.Op().(OperandDisplacement).Imm)
+		return append(code, e.opcode|d|w, byte(disp), byte(disp>>8)), nil
+	case KindImmToReg:
+		reg, w, ok := registerCode(dst.Op())
+		if !two || !ok || !isImmediate(src) {
+			return nil, invalid
+		}
+		if _, _, err := operandWidths(in.Op, dst, src); err != nil {
+			return nil, err
+		}
+		return appendImm(append(code, e.opcode|w<<3|reg), immValue(src.Op()), w)
+	case KindImmToAcc:
+		w, ok := accumulator(dst)
+		if !two || !ok || !isImmediate(src) {
+			return nil, invalid
+		}
+		if _, _, err := operandWidths(in.Op, dst, src); err != nil {
+			return nil, err
+		}
+		return appendImm(append(code, e.opcode|w), immValue(src.Op()), w)
+	case KindRmToSeg, KindSegToRm:
+		seg, rm := dst, src
+		if kind == KindSegToRm {
+			seg, rm = src, dst
+		}
+		sr, ok := segmentCode(seg.Op())
+		if !two || !ok {
+			return nil, invalid
+		}
+		if w, known, err := operandWidths(in.Op, rm); err != nil || known && w == 0 {
+			return nil, invalid
+		}
+		return appendModRM(append(code, e.opcode), rm, sr, f)
+	case KindCondJmp, KindNearJmp:
+		rel, ok := dst.Op().(OperandImm)
+		switch {
+		case !one || !ok:
+			return nil, invalid
+		case kind == KindNearJmp:
+			return append(code, e.opcode, byte(rel), byte(uint16(rel)>>8)), nil
+		case !fitsSigned8(uint16(rel)):
+			return nil, fmt.Errorf("%w: %d", ErrJumpOutOfRange, rel)
+		}
+		return append(code, e.opcode, byte(rel)), nil
+	case KindFarJmp:
+		p, ok := dst.Op().(OperandFarPtr)
+		if !one || !ok {
+			return nil, invalid
+		}
+		return append(code, e.opcode, byte(p.Offset), byte(p.Offset>>8), byte(p.Seg), byte(p.Seg>>8)), nil
+	case KindImm8, KindImm16:
+		if !one || !isImmediate(dst) {
+			return nil, invalid
+		}
+		return appendImm(append(code, e.opcode), immValue(dst.Op()), boolByte(kind == KindImm16))
+	case KindNone:
+		if len(ops) != 0 {
+			return nil, invalid
+		}
+		return append(code, e.opcode), nil
+	case KindAsciiAdjust:
+		// The number base is 10 unless specified otherwise.
+		switch {
+		case len(ops) == 0:
+			return append(code, e.opcode, 10), nil
+		case !one || !isImmediate(dst):
+			return nil, invalid
+		}
+		return appendImm(append(code, e.opcode), immValue(dst.Op()), 0)
+	case KindRm:
+		if !one {
+			return nil, invalid
+		}
+		w, known, err := operandWidths(in.Op, dst)
+		switch in.Op {
+		case OpPush, OpPop, OpCall, OpJmp:
+			// Always a word, or a far pointer for intersegment call and jmp.
+			if known && w == 0 || dst.Size == SizeFar && !isMemory(dst) {
+				return nil, invalid
+			}
+			w, err = 1, nil
+			if dst.Size == SizeFar && !f.decoded {
+				ext |= 1
+			}
+		default:
+			if err == nil && !known {
+				err = fmt.Errorf("%w: operation size not specified", invalid)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return appendModRM(append(code, e.opcode|w), dst, ext, f)
+	case KindReg:
+		reg, w, ok := registerCode(dst.Op())
+		if !one || !ok || w != 1 {
+			return nil, invalid
+		}
+		return append(code, e.opcode|reg), nil
+	case KindAccReg:
+		reg, ok := wordRegisterWith(dst, src, RegAx)
+		if !two || !ok {
+			return nil, invalid
+		}
+		return append(code, e.opcode|reg), nil
+	case KindSeg:
+		sr, ok := segmentCode(dst.Op())
+		if !one || !ok {
+			return nil, invalid
+		}
+		return append(code, e.opcode|sr<<3), nil
+	case KindShift:
+		var v byte
+		switch {
+		case !two:
+			return nil, invalid
+		case src.Op() == OperandReg{RegCx, WidthLo}:
+			v = 1
+		case !isImmediate(src) || immValue(src.Op()) != 1:
+			return nil, invalid
+		}
+		w, known, err := operandWidths(in.Op, dst)
+		if err == nil && !known {
+			err = fmt.Errorf("%w: operation size not specified", invalid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return appendModRM(append(code, e.opcode|v<<1|w), dst, ext, f)
+	case KindLoadAddr:
+		reg, w, ok := registerCode(dst.Op())
+		if !two || !ok || w != 1 || !isMemory(src) {
+			return nil, invalid
+		}
+		return appendModRM(append(code, e.opcode), src, reg, f)
+	case KindInOut:
+		// 1110v1dw where v selects a variable port in dx and d selects out.
+		acc, port := dst, src
+		if in.Op == OpOut {
+			acc, port = src, dst
+		}
+		w, ok := accumulator(acc)
+		switch {
+		case !two || !ok:
+			return nil, invalid
+		case port.Op() == OperandReg{RegDx, WidthFull}:
+			return append(code, e.opcode|0b1000|w), nil
+		case !isImmediate(port):
+			return nil, invalid
+		}
+		return appendImm(append(code, e.opcode|w), immValue(port.Op()), 0)
+	}
+	return nil, invalid
+}
+
+// Appends the ModRM byte, and any displacement, that address the
+// register/memory operand o, with reg in the REG field. The displacement is
+// as short as possible, unless the instruction was decoded.
+func appendModRM(code []byte, o Operand, reg byte, f encodingForm) ([]byte, error) {
+	switch op := o.Op().(type) {
+	case OperandReg:
+		rm, _, ok := registerCode(op)
+		if !ok {
+			break
+		}
+		return append(code, 0b11000000|reg<<3|rm), nil
+	case OperandDisplacement:
+		disp := uint16(op.Imm)
+		if op.Kind == DispEA {
+			return append(code, reg<<3|0b110, byte(disp), byte(disp>>8)), nil
+		}
+		n := f.dispLen
+		if !f.decoded {
+			switch {
+			case disp == 0 && op.Kind != DispBp:
+				// [bp] would be a direct address, it needs a displacement.
+				n = 0
+			case fitsSigned8(disp):
+				n = 1
+			default:
+				n = 2
+			}
+		}
+		modrm := byte(n)<<6 | reg<<3 | byte(op.Kind)
+		switch {
+		case n == 0 && disp == 0 && op.Kind != DispBp:
+			return append(code, modrm), nil
+		case n == 1 && fitsSigned8(disp):
+			return append(code, modrm, byte(disp)), nil
+		case n == 2:
+			return append(code, modrm, byte(disp), byte(disp>>8)), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s is not a register or memory operand", ErrInvalidOperands, o)
+}
+
+// Returns the width bit of the operands, which must agree, and whether it
+// is known at all. Registers have a width, while memory operands and
+// immediates only have one when they are sized.
+func operandWidths(op Op, ops ...Operand) (w byte, known bool, err error) {
+	for _, o := range ops {
+		var ow byte
+		switch o.Op().(type) {
+		case OperandReg:
+			var ok bool
+			if _, ow, ok = registerCode(o.Op()); !ok {
+				return 0, false, fmt.Errorf("%w for %s: %s", ErrInvalidOperands, op, o)
+			}
+		case OperandDisplacement, OperandImm, OperandImmU:
+			switch o.Size {
+			case SizeByte:
+				ow = 0
+			case SizeWord:
+				ow = 1
+			case SizeNone:
+				continue
+			default:
+				return 0, false, fmt.Errorf("%w for %s: %s", ErrInvalidOperands, op, o)
+			}
+		default:
+			return 0, false, fmt.Errorf("%w for %s: %s", ErrInvalidOperands, op, o)
+		}
+		if known && ow != w {
+			return 0, false, fmt.Errorf("%w for %s: mismatch in operand sizes", ErrInvalidOperands, op)
+		}
+		w, known = ow, true
+	}
+	return w, known, nil
+}
+
+// Returns the REG code and width bit of a general register.
+func registerCode(o OperandType) (code, w byte, ok bool) {
+	for i, r := range regVal {
+		if r == o {
+			return byte(i) & 0b111, byte(i) >> 3, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Returns the code of a segment register.
+func segmentCode(o OperandType) (byte, bool) {
+	for i, r := range segmentRegs {
+		if o == (OperandReg{r, WidthFull}) {
+			return byte(i), true
+		}
+	}
+	return 0, false
+}
+
+// Returns the width bit if o is al or ax.
+func accumulator(o Operand) (byte, bool) {
+	switch o.Op() {
+	case OperandReg{RegAx, WidthLo}:
+		return 0, true
+	case OperandReg{RegAx, WidthFull}:
+		return 1, true
+	}
+	return 0, false
+}
+
+// Returns the code of the word register that is paired with reg, in either
+// order.
+func wordRegisterWith(a, b Operand, reg Register) (byte, bool) {
+	r := OperandReg{reg, WidthFull}
+	if a.Op() == r {
+		a, b = b, a
+	} else if b.Op() != r {
+		return 0, false
+	}
+	code, w, ok := registerCode(a.Op())
+	return code, ok && w == 1
+}
+
+func isMemory(o Operand) bool {
+	_, ok := o.Op().(OperandDisplacement)
+	return ok
+}
+
+func isDirect(o Operand) bool {
+	d, ok := o.Op().(OperandDisplacement)
+	return ok && d.Kind == DispEA
+}
+
+func isImmediate(o Operand) bool {
+	switch o.Op().(type) {
+	case OperandImm, OperandImmU:
+		return true
+	}
+	return false
+}
+
+func immValue(o OperandType) uint16 {
+	switch o := o.(type) {
+	case OperandImm:
+		return uint16(o)
+	case OperandImmU:
+		return uint16(o)
+	}
+	panic(o)
+}
+
+func fitsSigned8(v uint16) bool {
+	return int16(v) >= -128 && int16(v) <= 127
+}
+
+func boolByte(b bool) byte {
+	return byte(boolToInt(b))
+}
+
+// Appends the immediate v as a byte or, with w set, a word.
+func appendImm(code []byte, v uint16, w byte) ([]byte, error) {
+	if w == 0 && v > 0xff && v < 0xff80 {
+		return nil, fmt.Errorf("%w: immediate %d does not fit in a byte", ErrInvalidOperands, int16(v))
+	}
+	code = append(code, byte(v))
+	if w == 1 {
+		code = append(code, byte(v>>8))
+	}
+	return code, nil
+}
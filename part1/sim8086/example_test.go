@@ -0,0 +1,94 @@
+package sim8086_test
+
+import (
+	"fmt"
+	"log"
+
+	"part1/sim8086"
+)
+
+func ExampleDecodeInstruction() {
+	code := []byte{
+		0x89, 0xd9, // mov cx, bx
+		0x8b, 0x46, 0x04, // mov ax, [bp+4]
+		0x75, 0xfb, // jne $-3
+	}
+	for ip := 0; ip < len(code); {
+		in, n, err := sim8086.DecodeInstruction(code, ip)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%-20s ; %v", in, in.Op)
+		for _, o := range in.Operands() {
+			switch o := o.Op().(type) {
+			case sim8086.OperandReg:
+				fmt.Printf(" register %s", o)
+			case sim8086.OperandDisplacement:
+				seg := sim8086.OperandReg{Name: o.Segment(), Width: sim8086.WidthFull}
+				fmt.Printf(" memory %s in %s", o, seg)
+			case sim8086.OperandImm:
+				fmt.Printf(" jump to %d", in.Target(ip))
+			}
+		}
+		fmt.Println()
+		ip += n
+	}
+	// Output:
+	// mov cx, bx           ; mov register cx register bx
+	// mov ax, word [bp+4]  ; mov register ax memory [bp+4] in ss
+	// jne $-3              ; jne jump to 2
+}
+
+func ExampleMachine_Step() {
+	code, err := sim8086.Assemble(`
+		mov cx, 3
+		mov ax, 0
+	again:
+		add ax, cx
+		loop again
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := sim8086.NewMachine(code, sim8086.SimOptions{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The machine halts when cs:ip reaches the end of the program.
+	for !m.Halted {
+		step, err := m.Step()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%-12s ax=%d cx=%d\n", step.Instruction, step.Regs[sim8086.RegAx], step.Regs[sim8086.RegCx])
+	}
+	fmt.Println(m.Executed, "instructions")
+	// Output:
+	// mov cx, 3    ax=0 cx=3
+	// mov ax, 0    ax=0 cx=3
+	// add ax, cx   ax=3 cx=3
+	// loop $-2     ax=3 cx=2
+	// add ax, cx   ax=5 cx=2
+	// loop $-2     ax=5 cx=1
+	// add ax, cx   ax=6 cx=1
+	// loop $-2     ax=6 cx=0
+	// 8 instructions
+}
+
+func ExampleEncode() {
+	in, _, err := sim8086.DecodeInstruction([]byte{0x05, 0x01, 0x00}, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The instruction encodes to the bytes it was decoded from, although
+	// NASM would have picked a shorter encoding.
+	fmt.Printf("%s: % x\n", in, sim8086.Encode(in))
+	code, err := sim8086.Assemble("add ax, 1")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s: % x\n", in, code)
+	// Output:
+	// add ax, 1: 05 01 00
+	// add ax, 1: 83 c0 01
+}
@@ -0,0 +1,152 @@
+package sim8086
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type PixelFormat uint32
+
+const (
+	// Four bytes per pixel: red, green, blue and alpha.
+	PixelRGBA PixelFormat = iota
+	// One byte per pixel, an index into a palette.
+	PixelIndexed
+)
+
+func (f PixelFormat) String() string {
+	switch f {
+	case PixelRGBA:
+		return "rgba"
+	case PixelIndexed:
+		return "indexed"
+	}
+	return fmt.Sprintf("PixelFormat(%d)", uint32(f))
+}
+
+func (f PixelFormat) bytesPerPixel() int {
+	if f == PixelIndexed {
+		return 1
+	}
+	return 4
+}
+
+// Framebuffer describes an image stored in memory, one row after another
+// without padding.
+type Framebuffer struct {
+	Format        PixelFormat
+	Offset        int // Physical address of the first pixel
+	Width, Height int
+	// Colors of indexed pixels. Without a palette, index i is the gray level i.
+	Palette color.Palette
+}
+
+// The framebuffer that listings 0054 and 0055 draw into.
+var DefaultFramebuffer = Framebuffer{Format: PixelRGBA, Offset: 64 * 4, Width: 64, Height: 64}
+
+var ErrBadFramebuffer = errors.New("bad framebuffer")
+
+// ParseFramebuffer parses a framebuffer of the form format:offset:WxH, where
+// format is rgba or indexed.
+func ParseFramebuffer(s string) (Framebuffer, error) {
+	var fb Framebuffer
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return fb, fmt.Errorf("%w %q: want format:offset:WxH", ErrBadFramebuffer, s)
+	}
+	switch parts[0] {
+	case "rgba":
+		fb.Format = PixelRGBA
+	case "indexed":
+		fb.Format = PixelIndexed
+	default:
+		return fb, fmt.Errorf("%w %q: format must be rgba or indexed", ErrBadFramebuffer, s)
+	}
+	offset, err := strconv.ParseUint(parts[1], 0, 20)
+	if err != nil {
+		return fb, fmt.Errorf("%w %q: %v", ErrBadFramebuffer, s, err)
+	}
+	fb.Offset = int(offset)
+	width, height, _ := strings.Cut(parts[2], "x")
+	w, err1 := strconv.ParseUint(width, 10, 20)
+	h, err2 := strconv.ParseUint(height, 10, 20)
+	if err1 != nil || err2 != nil {
+		return fb, fmt.Errorf("%w %q: invalid size", ErrBadFramebuffer, s)
+	}
+	fb.Width, fb.Height = int(w), int(h)
+	return fb, fb.check()
+}
+
+func (fb Framebuffer) String() string {
+	return fmt.Sprintf("%s:0x%05x:%dx%d", fb.Format, fb.Offset, fb.Width, fb.Height)
+}
+
+// Reports an error if the framebuffer does not fit in memory.
+func (fb Framebuffer) check() error {
+	if fb.Width <= 0 || fb.Height <= 0 {
+		return fmt.Errorf("%w %s: empty", ErrBadFramebuffer, fb)
+	}
+	if fb.Offset < 0 || fb.Offset+fb.Width*fb.Height*fb.Format.bytesPerPixel() > len(Memory{}) {
+		return fmt.Errorf("%w %s: past the end of memory", ErrBadFramebuffer, fb)
+	}
+	return nil
+}
+
+// Image returns a copy of the framebuffer in memory.
+func (fb Framebuffer) Image(mem *Memory) (image.Image, error) {
+	if err := fb.check(); err != nil {
+		return nil, err
+	}
+	r := image.Rect(0, 0, fb.Width, fb.Height)
+	pixels := mem[fb.Offset : fb.Offset+fb.Width*fb.Height*fb.Format.bytesPerPixel()]
+	if fb.Format == PixelIndexed {
+		palette := fb.Palette
+		if palette == nil {
+			palette = make(color.Palette, 256)
+			for i := range palette {
+				palette[i] = color.Gray{uint8(i)}
+			}
+		}
+		img := image.NewPaletted(r, palette)
+		copy(img.Pix, pixels)
+		return img, nil
+	}
+	// The alpha is not premultiplied into the colors in memory.
+	img := image.NewNRGBA(r)
+	copy(img.Pix, pixels)
+	return img, nil
+}
+
+// WritePNG writes the framebuffer in memory to w as a PNG image.
+func (fb Framebuffer) WritePNG(w io.Writer, mem *Memory) error {
+	img, err := fb.Image(mem)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+// WritePPM writes the framebuffer in memory to w as a binary PPM image. PPM
+// has no alpha channel, so the alpha is dropped.
+func (fb Framebuffer) WritePPM(w io.Writer, mem *Memory) error {
+	img, err := fb.Image(mem)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "P6\n%d %d\n255\n", fb.Width, fb.Height)
+	for y := 0; y < fb.Height; y++ {
+		for x := 0; x < fb.Width; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			bw.Write([]byte{c.R, c.G, c.B})
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,73 @@
+package sim8086
+
+import "errors"
+
+var ErrNoJournal = errors.New("no journal recorded")
+
+// The record of an executed instruction that is needed to undo it.
+type undo struct {
+	in       Instruction
+	regs     Registers // Registers before the instruction
+	clocks   int       // Total clocks before the instruction
+	accesses []memAccess
+}
+
+// StepBack undoes the last executed instruction, restoring the registers and
+// the memory it wrote. It reports false when there is nothing left in the
+// journal. Changes made to the machine from outside of Step, such as by the
+// debugger, are not undone.
+func (m *Machine) StepBack() bool {
+	if len(m.journal) == 0 {
+		return false
+	}
+	u := m.journal[len(m.journal)-1]
+	m.journal = m.journal[:len(m.journal)-1]
+	for i := len(u.accesses) - 1; i >= 0; i-- {
+		if a := u.accesses[i]; a.write {
+			m.Mem.Write(a.seg, a.offset, a.old, a.word)
+		}
+	}
+	m.Regs, m.Clocks, m.Halted = u.regs, u.clocks, false
+	m.Executed--
+	return true
+}
+
+// ReverseContinue steps back until cs:ip is at one of the breakpoints, given
+// as physical addresses, or until it undid an instruction whose memory
+// accesses are caught by a watchpoint. Undoing at least one instruction, it
+// returns the watchpoint hits it stopped at and reports false when it ran out
+// of journal instead.
+func (m *Machine) ReverseContinue(breakpoints map[int]bool) ([]WatchHit, bool) {
+	for {
+		if len(m.journal) == 0 {
+			return nil, false
+		}
+		u := m.journal[len(m.journal)-1]
+		m.StepBack()
+		if hits := watchHits(m.opts.Watchpoints, u.in, &u.regs, u.accesses); len(hits) > 0 {
+			return hits, true
+		}
+		if breakpoints[Physical(m.Regs[RegCs], m.Regs[RegIp])] {
+			return nil, true
+		}
+	}
+}
+
+// Goto steps forward or back until n instructions have been executed. Going
+// forward stops early when the program halts.
+func (m *Machine) Goto(n int) error {
+	for m.Executed > n {
+		if !m.StepBack() {
+			return ErrNoJournal
+		}
+	}
+	for m.Executed < n {
+		if _, err := m.Step(); err != nil {
+			return err
+		}
+		if m.Halted {
+			break
+		}
+	}
+	return nil
+}
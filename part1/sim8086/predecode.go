@@ -0,0 +1,109 @@
+package sim8086
+
+// An instruction decoded for execution from the cache, with a function that
+// executes it. The function is specialized for the common instructions, so
+// that they skip the dispatch on the operation in executor.execute.
+type compiled struct {
+	in      Instruction
+	advance int
+	word    bool   // Operates on words, see isWordOperation
+	code    string // The bytes it was decoded from, empty if not cached
+	run     func(x *executor) error
+}
+
+// Instructions are cached by physical address in pages, which are allocated
+// as the program executes code in them.
+const codePageBits = 8
+
+type codeCache [len(Memory{}) >> codePageBits]*[1 << codePageBits]compiled
+
+// Returns the instruction at cs:ip from the cache, decoding it if it is not
+// cached yet. An entry is only used while memory still holds the bytes it was
+// decoded from, so that writing to code invalidates it, no matter whether
+// the program, an interrupt handler or the debugger wrote it.
+func (m *Machine) predecoded(cs, ip uint16) (*compiled, error) {
+	if m.code == nil {
+		m.code = new(codeCache)
+	}
+	addr := Physical(cs, ip)
+	page := m.code[addr>>codePageBits]
+	if page == nil {
+		page = new([1 << codePageBits]compiled)
+		m.code[addr>>codePageBits] = page
+	}
+	c := &page[addr&(1<<codePageBits-1)]
+	if n := len(c.code); n > 0 && string(m.Mem[addr:addr+n]) == c.code {
+		return c, nil
+	}
+	in, advance, err := fetch(m.Mem, cs, ip, m.opts.lookup)
+	if err != nil {
+		return nil, err
+	}
+	// An instruction that wraps around the end of its segment or of memory
+	// has different bytes at different cs:ip with the same address, it is
+	// decoded every time.
+	if int(ip)+advance > 0x10000 || addr+advance > len(m.Mem) {
+		return compile(in, advance), nil
+	}
+	*c = *compile(in, advance)
+	c.code = string(m.Mem[addr : addr+advance])
+	return c, nil
+}
+
+// Returns the instruction with the function that executes it.
+func compile(in Instruction, advance int) *compiled {
+	word := len(in.Operands()) > 0 && isWordOperation(in)
+	c := &compiled{in: in, advance: advance, word: word}
+	dst, src := in.operands[0], in.operands[1]
+	switch op := in.Op; op {
+	case OpMov:
+		switch {
+		case dst.kind == operandReg && dst.reg.Width == WidthFull && src.kind == operandReg && src.reg.Width == WidthFull:
+			d, s := dst.reg.Name, src.reg.Name
+			c.run = func(x *executor) error {
+				x.regs[d] = x.regs[s]
+				return nil
+			}
+		case dst.kind == operandReg && dst.reg.Width == WidthFull && (src.kind == operandImm || src.kind == operandImmU):
+			d, v := dst.reg.Name, src.imm
+			c.run = func(x *executor) error {
+				x.regs[d] = v
+				return nil
+			}
+		default:
+			c.run = func(x *executor) error {
+				x.store(dst, x.load(src, word), word)
+				return nil
+			}
+		}
+	case OpAdd, OpAdc, OpSub, OpSbb, OpCmp, OpAnd, OpOr, OpXor, OpTest,
+		OpInc, OpDec, OpNeg, OpNot:
+		c.run = func(x *executor) error {
+			x.arithmetic(op, dst, src, word)
+			return nil
+		}
+	case OpJe, OpJl, OpJle, OpJb, OpJbe, OpJp, OpJo, OpJs,
+		OpJne, OpJnl, OpJnle, OpJnb, OpJnbe, OpJnp, OpJno, OpJns, OpJcxz:
+		cond, rel := jumpCondition(op), dst.imm
+		c.run = func(x *executor) error {
+			if x.taken = cond(x.regs); x.taken {
+				x.regs[RegIp] += rel
+			}
+			return nil
+		}
+	case OpLoop, OpLoopz, OpLoopnz:
+		cond, rel := jumpCondition(op), dst.imm
+		c.run = func(x *executor) error {
+			x.regs[RegCx]--
+			if x.taken = cond(x.regs); x.taken {
+				x.regs[RegIp] += rel
+			}
+			return nil
+		}
+	default:
+		c.run = func(x *executor) error {
+			return x.execute(&in, word)
+		}
+	}
+	return c
+}
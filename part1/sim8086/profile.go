@@ -0,0 +1,79 @@
+package sim8086
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Profile collects the executions of the instructions of a simulated
+// program, by the physical address of the instruction. Set
+// SimOptions.Profile to collect it.
+type Profile struct {
+	Instructions map[int]*InstructionProfile
+	Executed     int // Instructions executed
+	Clocks       int // Estimated clocks of the executed instructions
+}
+
+// The executions of the instruction at an address. Self-modifying code can
+// put different instructions at the same address, the last one executed is
+// kept.
+type InstructionProfile struct {
+	Instruction Instruction
+	Count       int
+	Clocks      int
+	// Executions that took the branch, for a conditional jump or loop.
+	Taken int
+}
+
+func NewProfile() *Profile {
+	return &Profile{Instructions: make(map[int]*InstructionProfile)}
+}
+
+func (p *Profile) add(addr int, in Instruction, clocks int, taken bool) {
+	prof := p.Instructions[addr]
+	if prof == nil {
+		prof = new(InstructionProfile)
+		p.Instructions[addr] = prof
+	}
+	prof.Instruction = in
+	prof.Count++
+	prof.Clocks += clocks
+	if taken {
+		prof.Taken++
+	}
+	p.Executed++
+	p.Clocks += clocks
+}
+
+// Reports whether the instruction is a branch that can go either way.
+func isBranch(in Instruction) bool {
+	return in.IsRelJump() && in.Op != OpJmp && in.Op != OpCall
+}
+
+// WriteReport writes the executed instructions in the order of their
+// addresses, annotated with how often they were executed, their clocks and
+// their share of the total clocks. Branches show how often they were taken.
+func (p *Profile) WriteReport(w io.Writer) {
+	pct := func(n, total int) float64 {
+		if total == 0 {
+			return 0
+		}
+		return 100 * float64(n) / float64(total)
+	}
+	addrs := make([]int, 0, len(p.Instructions))
+	for addr := range p.Instructions {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+	fmt.Fprintf(w, "Profile: %d instructions, %d clocks\n", p.Executed, p.Clocks)
+	fmt.Fprintf(w, "%-7s %9s %11s %8s   %s\n", "address", "count", "clocks", "%", "instruction")
+	for _, addr := range addrs {
+		prof := p.Instructions[addr]
+		fmt.Fprintf(w, "0x%05x %9d %11d %6.2f %%   %s", addr, prof.Count, prof.Clocks, pct(prof.Clocks, p.Clocks), prof.Instruction)
+		if isBranch(prof.Instruction) {
+			fmt.Fprintf(w, " ; taken %d (%.2f %%), not taken %d", prof.Taken, pct(prof.Taken, prof.Count), prof.Count-prof.Taken)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,733 @@
+package sim8086
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	ErrUnimplemented = errors.New("unimplemented instruction")
+	ErrEndOfProgram  = errors.New("end of program")
+)
+
+type SimOptions struct {
+	// CPU to estimate clocks for.
+	CPU CPU
+	// Segment that Simulate loads the program at. All segment registers
+	// start out pointing at it.
+	LoadSegment uint16
+	// Handlers for software interrupts that are serviced by the simulator
+	// rather than through the interrupt vector table.
+	Interrupts Interrupts
+	// Watchpoints on memory, which are checked after every instruction.
+	Watchpoints []Watchpoint
+	// Include memory reads in the trace, not only writes.
+	LogAccesses bool
+	// Record a journal of the executed instructions, so that they can be
+	// undone with StepBack.
+	Record bool
+	// Decode every instruction once and execute it from a cache, instead of
+	// decoding it every time it executes.
+	Predecode bool
+	// Collects the execution profile of every instruction, if not nil.
+	Profile *Profile
+	// Looks up operations instead of the opcode table, for the benchmarks.
+	lookup func(b1, b2 byte) OpDescr
+}
+
+// Simulate loads the program in buf at offset 0 of opts.LoadSegment and
+// executes it until it halts or exits, or cs:ip reaches the end of the
+// program. The trace of every instruction is written to w.
+func Simulate(w io.Writer, buf []byte, opts SimOptions) (Registers, *Memory, error) {
+	m, err := NewMachine(buf, opts)
+	if err != nil {
+		return Registers{}, nil, err
+	}
+	err = m.Run(w)
+	return m.Regs, m.Mem, err
+}
+
+// SimulateCOM loads the image as a DOS .COM program and executes it until it
+// halts or exits. The DOS services are not provided by default, see
+// DOSServices.
+func SimulateCOM(w io.Writer, image []byte, opts SimOptions) (Registers, *Memory, error) {
+	m, err := NewCOMMachine(image, opts)
+	if err != nil {
+		return Registers{}, nil, err
+	}
+	err = m.Run(w)
+	return m.Regs, m.Mem, err
+}
+
+// Machine is a simulated 8086 with a program loaded into its memory. It
+// executes one instruction at a time with Step, so that the simulation can
+// be stopped and resumed.
+type Machine struct {
+	Regs Registers
+	Mem  *Memory
+	// Total clocks of the instructions executed so far.
+	Clocks int
+	// Set when the last instruction halted or exited the program, or left
+	// cs:ip at its end.
+	Halted bool
+	// Number of instructions executed so far.
+	Executed int
+	opts     SimOptions
+	end      int // Physical address of the end of the program, or -1
+	journal  []undo
+	exec     executor
+	code     *codeCache // Instructions decoded so far, with Predecode
+}
+
+// NewMachine returns a machine with the program in buf loaded the way
+// Simulate loads it.
+func NewMachine(buf []byte, opts SimOptions) (*Machine, error) {
+	if len(buf) >= 0x10000 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrImageTooLarge, len(buf))
+	}
+	seg := opts.LoadSegment
+	m := &Machine{Mem: new(Memory), opts: opts, end: Physical(seg, uint16(len(buf)))}
+	for i, b := range buf {
+		m.Mem.Write(seg, uint16(i), uint16(b), false)
+	}
+	m.Regs[RegCs], m.Regs[RegDs], m.Regs[RegEs], m.Regs[RegSs] = seg, seg, seg, seg
+	return m, nil
+}
+
+// NewCOMMachine returns a machine with the image loaded as a DOS .COM
+// program. A .COM program ends by calling DOS, so the machine does not stop at
+// the end of the image.
+func NewCOMMachine(image []byte, opts SimOptions) (*Machine, error) {
+	m := &Machine{Mem: new(Memory), opts: opts, end: -1}
+	var err error
+	m.Regs, err = LoadCOM(m.Mem, image, comSegment)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Run executes instructions until the program halts, exits or reaches its
+// end, or a watchpoint halts it. The trace of every instruction is written
+// to w, followed by the total clocks and the final registers.
+func (m *Machine) Run(w io.Writer) error {
+	// Formatting the trace costs more than executing the instructions, skip
+	// it when nobody reads it.
+	trace := w != io.Discard
+	for !m.atEnd() {
+		step, err := m.Step()
+		if err != nil {
+			return err
+		}
+		if trace {
+			fmt.Fprintln(w, step)
+		}
+		if m.Halted {
+			break
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Total clocks (%s): %d\n", m.opts.CPU, m.Clocks)
+	fmt.Fprintln(w, m.Regs.Summary())
+	return nil
+}
+
+// Step is the record of an executed instruction, as printed in the trace.
+type Step struct {
+	Instruction Instruction
+	Prev        Registers // Registers before the instruction
+	Regs        Registers // Registers after the instruction
+	Clocks      Clocks
+	Total       int // Total clocks including the instruction
+	Hits        []WatchHit
+	// Memory accesses of the instruction. Reads are only included when
+	// SimOptions.LogAccesses is set.
+	accesses []memAccess
+}
+
+func (s Step) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s ; Clocks: %+d = %d", s.Instruction, s.Clocks.Total(), s.Total)
+	if s.Clocks.EA != 0 || s.Clocks.Penalty != 0 {
+		fmt.Fprintf(&sb, " (%s)", s.Clocks)
+	}
+	sb.WriteString(" |")
+	// Write out state changes
+	for r := RegAx; r < RegFlags; r++ {
+		t0, t1 := s.Prev[r], s.Regs[r]
+		if t0 != t1 {
+			fmt.Fprintf(&sb, " %s:0x%x->0x%x", OperandReg{r, WidthFull}, t0, t1)
+		}
+	}
+	f0, f1 := s.Prev[RegFlags], s.Regs[RegFlags]
+	if f0 != f1 {
+		fmt.Fprintf(&sb, " flags:%s->%s", FlagsString(f0), FlagsString(f1))
+	}
+	for _, a := range s.accesses {
+		fmt.Fprintf(&sb, " %s", a)
+	}
+	for _, h := range s.Hits {
+		fmt.Fprintf(&sb, "\n; %s", h)
+	}
+	return sb.String()
+}
+
+// Step executes the instruction at cs:ip. Halted is set when the instruction
+// halts or exits the program, or hits a watchpoint that halts, and stepping
+// again resumes after it. Halted is also set when the instruction leaves
+// cs:ip at the end of the program, after which Step returns ErrEndOfProgram.
+// With Predecode, the instruction comes from a cache of decoded
+// instructions, which it is added to on first execution.
+func (m *Machine) Step() (Step, error) {
+	regs, mem, opts := &m.Regs, m.Mem, &m.opts
+	if m.atEnd() {
+		m.Halted = true
+		return Step{}, ErrEndOfProgram
+	}
+	m.Halted = false
+	x := &m.exec
+	*x = executor{regs: regs, mem: mem, opts: opts}
+	// Reads are only recorded when somebody is interested in them.
+	x.logReads = opts.LogAccesses || opts.Record
+	for _, wp := range opts.Watchpoints {
+		x.logReads = x.logReads || wp.Read
+	}
+	var c *compiled
+	if opts.Predecode {
+		var err error
+		if c, err = m.predecoded(regs[RegCs], regs[RegIp]); err != nil {
+			return Step{}, err
+		}
+	} else {
+		in, advance, err := fetch(mem, regs[RegCs], regs[RegIp], opts.lookup)
+		if err != nil {
+			return Step{}, err
+		}
+		word := len(in.Operands()) > 0 && isWordOperation(in)
+		c = &compiled{in: in, advance: advance, word: word}
+	}
+	in, advance, accesses := c.in, c.advance, &x.accesses
+	regsPrev := *regs
+	regs[RegIp] += uint16(advance)
+	var err error
+	if c.run != nil {
+		err = c.run(x)
+	} else {
+		err = x.execute(&in, c.word)
+	}
+	m.Halted = errors.Is(err, ErrExit)
+	if err != nil && !m.Halted {
+		return Step{}, err
+	}
+	m.Halted = m.Halted || m.atEnd()
+	taken := x.taken
+	clocks := EstimateClocks(opts.CPU, in, &regsPrev, taken)
+	m.Clocks += clocks.Total()
+	m.Executed++
+	if opts.Profile != nil {
+		opts.Profile.add(Physical(regsPrev[RegCs], regsPrev[RegIp]), in, clocks.Total(), taken)
+	}
+	if opts.Record {
+		m.journal = append(m.journal, undo{in, regsPrev, m.Clocks - clocks.Total(), *accesses})
+	}
+	step := Step{Instruction: in, Prev: regsPrev, Regs: *regs, Clocks: clocks, Total: m.Clocks}
+	step.Hits = watchHits(opts.Watchpoints, in, &regsPrev, *accesses)
+	for _, h := range step.Hits {
+		m.Halted = m.Halted || h.Watchpoint.Halt
+	}
+	for _, a := range *accesses {
+		if a.write || opts.LogAccesses {
+			step.accesses = append(step.accesses, a)
+		}
+	}
+	return step, nil
+}
+
+// Reports whether cs:ip is at the end of the program.
+func (m *Machine) atEnd() bool {
+	return Physical(m.Regs[RegCs], m.Regs[RegIp]) == m.end
+}
+
+// Executes instructions against the registers and memory of a machine, and
+// records the memory accesses of the instruction being executed.
+type executor struct {
+	regs     *Registers
+	mem      *Memory
+	opts     *SimOptions
+	logReads bool
+	accesses []memAccess
+	// Set when a conditional jump or loop, or into, takes its branch. The
+	// target alone does not tell, a jump can go to the next instruction.
+	taken bool
+}
+
+func (x *executor) read(seg, offset uint16, word bool) uint16 {
+	value := x.mem.Read(seg, offset, word)
+	if x.logReads {
+		x.accesses = append(x.accesses, memAccess{seg: seg, offset: offset, old: value, new: value, word: word})
+	}
+	return value
+}
+
+func (x *executor) write(seg, offset uint16, value uint16, word bool) {
+	a := memAccess{seg: seg, offset: offset, word: word, write: true}
+	a.old = x.mem.Read(seg, offset, word)
+	x.mem.Write(seg, offset, value, word)
+	a.new = x.mem.Read(seg, offset, word)
+	x.accesses = append(x.accesses, a)
+}
+
+func (x *executor) load(src Operand, word bool) uint16 {
+	if src.kind == operandDisp {
+		return x.read(x.regs[src.disp.Segment()], dispOffset(x.regs, src.disp), word)
+	}
+	return load(x.regs, x.mem, src, word)
+}
+
+// Far pointers are stored as the offset followed by the segment.
+func (x *executor) loadFar(d OperandDisplacement) (seg, offset uint16) {
+	s, o := x.regs[d.Segment()], dispOffset(x.regs, d)
+	offset = x.read(s, o, true)
+	return x.read(s, o+2, true), offset
+}
+
+func (x *executor) store(dst Operand, value uint16, word bool) {
+	if a, ok := store(x.regs, x.mem, dst, value, word); ok {
+		x.accesses = append(x.accesses, a)
+	}
+}
+
+func (x *executor) push(value uint16) {
+	x.accesses = append(x.accesses, push(x.regs, x.mem, value))
+}
+
+func (x *executor) pop() uint16 {
+	value := x.read(x.regs[RegSs], x.regs[RegSp], true)
+	x.regs[RegSp] += 2
+	return value
+}
+
+// Applies an arithmetic or logic operation to dst and src, or to dst alone
+// for the unary operations, and stores the result.
+func (x *executor) arithmetic(op Op, dst, src Operand, word bool) {
+	a, b := x.load(dst, word), uint16(0)
+	if src.kind != operandNone {
+		b = x.load(src, word)
+	}
+	var value uint16
+	value, x.regs[RegFlags] = applyArithmetic(op, word, a, b, x.regs[RegFlags])
+	// Cmp and test are implemented like sub and and but do not write their
+	// result.
+	if op != OpCmp && op != OpTest {
+		x.store(dst, value, word)
+	}
+}
+
+// Interrupts push the flags and the return address, and jump through the
+// vector table at the start of memory.
+func (x *executor) interrupt(n uint8) error {
+	regs := x.regs
+	if handler := x.opts.Interrupts[n]; handler != nil {
+		return handler(regs, x.mem)
+	}
+	x.push(regs[RegFlags] | reservedFlags)
+	regs[RegFlags] &^= FlagI | FlagT
+	x.push(regs[RegCs])
+	x.push(regs[RegIp])
+	regs[RegIp] = x.read(0, uint16(n)*4, true)
+	regs[RegCs] = x.read(0, uint16(n)*4+2, true)
+	return nil
+}
+
+// Executes the instruction, with ip already pointing past it. Word is
+// whether it operates on words, see isWordOperation.
+func (x *executor) execute(in *Instruction, word bool) error {
+	regs := x.regs
+	var err error
+	switch in.Op {
+	case OpMov:
+		x.store(in.Operands()[0], x.load(in.Operands()[1], word), word)
+	case OpAdd, OpAdc, OpSub, OpSbb, OpCmp, OpAnd, OpOr, OpXor, OpTest,
+		OpInc, OpDec, OpNeg, OpNot:
+		x.arithmetic(in.Op, in.operands[0], in.operands[1], word)
+	case OpShl, OpShr, OpSar, OpRol, OpRor, OpRcl, OpRcr:
+		dst := in.Operands()[0]
+		count := uint8(x.load(in.Operands()[1], false))
+		var value uint16
+		value, regs[RegFlags] = applyShift(in.Op, word, x.load(dst, word), count, regs[RegFlags])
+		x.store(dst, value, word)
+	case OpMul, OpImul, OpDiv, OpIdiv:
+		if err := applyMulDiv(regs, in.Op, word, x.load(in.Operands()[0], word)); err != nil {
+			return err
+		}
+	case OpCbw, OpCwd, OpDaa, OpDas, OpAaa, OpAas, OpAam, OpAad:
+		base := uint8(10)
+		if len(in.Operands()) > 0 {
+			base = uint8(x.load(in.Operands()[0], false))
+		}
+		if err := applyAdjust(regs, in.Op, base); err != nil {
+			return err
+		}
+	case OpPush:
+		value := x.load(in.Operands()[0], true)
+		// The 8086 pushes the value sp has after it was decremented.
+		if r, ok := in.Operands()[0].Op().(OperandReg); ok && r.Name == RegSp {
+			value -= 2
+		}
+		x.push(value)
+	case OpPop:
+		x.store(in.Operands()[0], x.pop(), true)
+	case OpPushf:
+		x.push(regs[RegFlags] | reservedFlags)
+	case OpPopf:
+		regs[RegFlags] = x.pop() & allFlags
+	case OpLahf:
+		ah := regs[RegFlags]&lahfFlags | reservedFlags&0xff
+		regs[RegAx] = ah<<8 | regs[RegAx]&0xff
+	case OpSahf:
+		regs[RegFlags] = regs[RegFlags]&^lahfFlags | regs[RegAx]>>8&lahfFlags
+	case OpClc:
+		regs[RegFlags] &^= FlagC
+	case OpStc:
+		regs[RegFlags] |= FlagC
+	case OpCmc:
+		regs[RegFlags] ^= FlagC
+	case OpCld:
+		regs[RegFlags] &^= FlagD
+	case OpStd:
+		regs[RegFlags] |= FlagD
+	case OpCli:
+		regs[RegFlags] &^= FlagI
+	case OpSti:
+		regs[RegFlags] |= FlagI
+	case OpCall, OpJmp:
+		dst := in.Operands()[0]
+		seg, offset, far := regs[RegCs], uint16(0), false
+		switch v := dst.Op().(type) {
+		case OperandImm:
+			offset = regs[RegIp] + uint16(v)
+		case OperandFarPtr:
+			seg, offset, far = v.Seg, v.Offset, true
+		case OperandDisplacement:
+			if dst.Size == SizeFar {
+				seg, offset = x.loadFar(v)
+				far = true
+			} else {
+				offset = x.load(dst, true)
+			}
+		default:
+			offset = x.load(dst, true)
+		}
+		if in.Op == OpCall {
+			if far {
+				x.push(regs[RegCs])
+			}
+			x.push(regs[RegIp])
+		}
+		regs[RegCs], regs[RegIp] = seg, offset
+	case OpRet, OpRetf:
+		regs[RegIp] = x.pop()
+		if in.Op == OpRetf {
+			regs[RegCs] = x.pop()
+		}
+		// The immediate is the number of bytes of arguments to discard.
+		if len(in.Operands()) > 0 {
+			regs[RegSp] += x.load(in.Operands()[0], true)
+		}
+	case OpInt:
+		err = x.interrupt(uint8(x.load(in.Operands()[0], false)))
+	case OpInt3:
+		err = x.interrupt(3)
+	case OpInto:
+		if x.taken = regs.IsSet(FlagO); x.taken {
+			err = x.interrupt(4)
+		}
+	case OpIret:
+		regs[RegIp] = x.pop()
+		regs[RegCs] = x.pop()
+		regs[RegFlags] = x.pop() & allFlags
+	case OpHlt:
+		// There is nothing to resume from a halt without hardware
+		// interrupts, so it ends the simulation.
+		err = ErrExit
+	case OpXchg:
+		dst, src := in.Operands()[0], in.Operands()[1]
+		a, b := x.load(dst, word), x.load(src, word)
+		x.store(dst, b, word)
+		x.store(src, a, word)
+	case OpLea:
+		x.store(in.Operands()[0], dispOffset(regs, in.Operands()[1].disp), true)
+	case OpLds, OpLes:
+		seg, offset := x.loadFar(in.Operands()[1].disp)
+		x.store(in.Operands()[0], offset, true)
+		if in.Op == OpLds {
+			regs[RegDs] = seg
+		} else {
+			regs[RegEs] = seg
+		}
+	case OpXlat:
+		seg := RegDs
+		if in.Prefix.Seg != SegNone {
+			seg = in.Prefix.Seg.Register()
+		}
+		al := x.read(regs[seg], regs[RegBx]+regs[RegAx]&0xff, false)
+		regs[RegAx] = regs[RegAx]&0xff00 | al
+	case OpIn:
+		// No devices are attached to the ports, reading one returns all ones
+		// like an idle bus.
+		x.store(in.Operands()[0], 0xffff, word)
+	case OpOut:
+		// Writes to ports go nowhere, see OpIn.
+	case OpMovsb, OpMovsw, OpCmpsb, OpCmpsw, OpScasb, OpScasw,
+		OpLodsb, OpLodsw, OpStosb, OpStosw:
+		x.stringOp(in)
+	case OpWait:
+		// Without a coprocessor there is nothing to wait for.
+	case OpJe, OpJl, OpJle, OpJb, OpJbe, OpJp, OpJo, OpJs,
+		OpJne, OpJnl, OpJnle, OpJnb, OpJnbe, OpJnp, OpJno, OpJns, OpJcxz:
+		x.taken = jumpCondition(in.Op)(regs)
+		regs.JumpIf(x.taken, in.Operands()[0])
+	case OpLoop, OpLoopz, OpLoopnz:
+		// Loop instruction decrements cx but does not change any flags.
+		regs[RegCx]--
+		x.taken = jumpCondition(in.Op)(regs)
+		regs.JumpIf(x.taken, in.Operands()[0])
+	default:
+		return fmt.Errorf("%w: %s", ErrUnimplemented, in)
+	}
+	return err
+}
+
+// Executes a string instruction, repeated cx times with a rep prefix. Cmps
+// and scas also stop repeating when the zero flag does not match the
+// prefix, repe or repne. The source is ds:si, or the segment override, and
+// the destination es:di.
+func (x *executor) stringOp(in *Instruction) {
+	regs := x.regs
+	var word bool
+	switch in.Op {
+	case OpMovsw, OpCmpsw, OpScasw, OpLodsw, OpStosw:
+		word = true
+	}
+	delta := uint16(1 + boolByte(word))
+	if regs.IsSet(FlagD) {
+		delta = -delta
+	}
+	srcSeg := RegDs
+	if in.Prefix.Seg != SegNone {
+		srcSeg = in.Prefix.Seg.Register()
+	}
+	acc := unsized(OperandReg{RegAx, [...]RegisterWidth{WidthLo, WidthFull}[boolByte(word)]})
+	rep := in.Prefix.Rep != RepNone
+	for !rep || regs[RegCx] != 0 {
+		var compared bool
+		switch in.Op {
+		case OpMovsb, OpMovsw:
+			x.write(regs[RegEs], regs[RegDi], x.read(regs[srcSeg], regs[RegSi], word), word)
+			regs[RegSi] += delta
+			regs[RegDi] += delta
+		case OpCmpsb, OpCmpsw:
+			a := x.read(regs[srcSeg], regs[RegSi], word)
+			b := x.read(regs[RegEs], regs[RegDi], word)
+			_, regs[RegFlags] = applyArithmetic(OpCmp, word, a, b, regs[RegFlags])
+			regs[RegSi] += delta
+			regs[RegDi] += delta
+			compared = true
+		case OpScasb, OpScasw:
+			b := x.read(regs[RegEs], regs[RegDi], word)
+			_, regs[RegFlags] = applyArithmetic(OpCmp, word, x.load(acc, word), b, regs[RegFlags])
+			regs[RegDi] += delta
+			compared = true
+		case OpLodsb, OpLodsw:
+			x.store(acc, x.read(regs[srcSeg], regs[RegSi], word), word)
+			regs[RegSi] += delta
+		case OpStosb, OpStosw:
+			x.write(regs[RegEs], regs[RegDi], x.load(acc, word), word)
+			regs[RegDi] += delta
+		}
+		if !rep {
+			return
+		}
+		regs[RegCx]--
+		if compared && regs.IsSet(FlagZ) != (in.Prefix.Rep == Rep) {
+			return
+		}
+	}
+}
+
+// The conditions of the conditional jumps and loops, from OpJe to OpJcxz.
+// Loops test theirs after decrementing cx.
+var jumpConditions = [...]func(rr *Registers) bool{
+	OpJe - OpJe:     func(rr *Registers) bool { return rr.IsSet(FlagZ) },
+	OpJl - OpJe:     func(rr *Registers) bool { return rr.IsSet(FlagS) != rr.IsSet(FlagO) },
+	OpJle - OpJe:    func(rr *Registers) bool { return rr.IsSet(FlagZ) || rr.IsSet(FlagS) != rr.IsSet(FlagO) },
+	OpJb - OpJe:     func(rr *Registers) bool { return rr.IsSet(FlagC) },
+	OpJbe - OpJe:    func(rr *Registers) bool { return rr.IsSet(FlagC | FlagZ) },
+	OpJp - OpJe:     func(rr *Registers) bool { return rr.IsSet(FlagP) },
+	OpJo - OpJe:     func(rr *Registers) bool { return rr.IsSet(FlagO) },
+	OpJs - OpJe:     func(rr *Registers) bool { return rr.IsSet(FlagS) },
+	OpJne - OpJe:    func(rr *Registers) bool { return !rr.IsSet(FlagZ) },
+	OpJnl - OpJe:    func(rr *Registers) bool { return rr.IsSet(FlagS) == rr.IsSet(FlagO) },
+	OpJnle - OpJe:   func(rr *Registers) bool { return !rr.IsSet(FlagZ) && rr.IsSet(FlagS) == rr.IsSet(FlagO) },
+	OpJnb - OpJe:    func(rr *Registers) bool { return !rr.IsSet(FlagC) },
+	OpJnbe - OpJe:   func(rr *Registers) bool { return !rr.IsSet(FlagC) && !rr.IsSet(FlagZ) },
+	OpJnp - OpJe:    func(rr *Registers) bool { return !rr.IsSet(FlagP) },
+	OpJno - OpJe:    func(rr *Registers) bool { return !rr.IsSet(FlagO) },
+	OpJns - OpJe:    func(rr *Registers) bool { return !rr.IsSet(FlagS) },
+	OpLoop - OpJe:   func(rr *Registers) bool { return rr[RegCx] != 0 },
+	OpLoopz - OpJe:  func(rr *Registers) bool { return rr[RegCx] != 0 && rr.IsSet(FlagZ) },
+	OpLoopnz - OpJe: func(rr *Registers) bool { return rr[RegCx] != 0 && !rr.IsSet(FlagZ) },
+	OpJcxz - OpJe:   func(rr *Registers) bool { return rr[RegCx] == 0 },
+}
+
+func jumpCondition(op Op) func(rr *Registers) bool {
+	return jumpConditions[op-OpJe]
+}
+
+// Instructions are at most six bytes long, but can have any number of
+// prefixes in front.
+const fetchLen = 16
+
+// Decodes the instruction at cs:ip, see decodeInstruction for lookup. The
+// instruction bytes wrap around within the code segment.
+func fetch(mem *Memory, cs, ip uint16, lookup func(b1, b2 byte) OpDescr) (Instruction, int, error) {
+	var window [fetchLen]byte
+	for i := range window {
+		window[i] = mem[Physical(cs, ip+uint16(i))]
+	}
+	in, advance, err := decodeInstruction(window[:], 0, lookup)
+	if de, ok := err.(*DecodeError); ok {
+		de.Offset = Physical(cs, ip)
+	}
+	return in, advance, err
+}
+
+// Reports whether the instruction operates on words rather than bytes. The
+// size of a memory operand is not always explicit, in which case it is given
+// by the register operand.
+func isWordOperation(in Instruction) bool {
+	switch dst := in.Operands()[0]; x := dst.Op().(type) {
+	case OperandReg:
+		return x.Width == WidthFull
+	case OperandDisplacement:
+		if dst.Size != SizeNone {
+			return dst.Size == SizeWord
+		}
+	}
+	if len(in.Operands()) > 1 {
+		if x, ok := in.Operands()[1].Op().(OperandReg); ok {
+			return x.Width == WidthFull
+		}
+	}
+	return false
+}
+
+// A read or write of memory, recorded for the trace. Reads have the value
+// read as both the old and the new value.
+type memAccess struct {
+	seg, offset uint16
+	old, new    uint16
+	word        bool
+	write       bool
+}
+
+// Returns the physical address of the access.
+func (a memAccess) addr() int {
+	return Physical(a.seg, a.offset)
+}
+
+func (a memAccess) String() string {
+	if !a.write {
+		return fmt.Sprintf("[0x%x]=0x%x", a.addr(), a.new)
+	}
+	return fmt.Sprintf("[0x%x]:0x%x->0x%x", a.addr(), a.old, a.new)
+}
+
+// Returns the byte or word value of a register, memory or immediate operand.
+// Half registers and bytes are returned as a plain value, for example ah
+// returns ah no matter what is in al.
+func load(regs *Registers, mem *Memory, src Operand, word bool) uint16 {
+	switch src.kind {
+	case operandImm, operandImmU:
+		return src.imm
+	case operandReg:
+		x := src.reg
+		switch x.Width {
+		case WidthFull:
+			return uint16(regs[x.Name])
+		case WidthLo:
+			return uint16(regs[x.Name] & 0xff)
+		case WidthHi:
+			return uint16((regs[x.Name] >> 8) & 0xff)
+		}
+	case operandDisp:
+		return mem.Read(regs[src.disp.Segment()], dispOffset(regs, src.disp), word)
+	}
+	panic(src)
+}
+
+// Writes the byte or word value to a register or memory operand. Memory
+// writes are returned so that they can be traced.
+func store(regs *Registers, mem *Memory, dst Operand, value uint16, word bool) (memAccess, bool) {
+	switch dst.kind {
+	case operandReg:
+		// When operating on half registers only the high or low bits of the
+		// full register are modified.
+		r := &regs[dst.reg.Name]
+		switch dst.reg.Width {
+		case WidthFull:
+			*r = value
+		case WidthLo:
+			*r = value&0xff | *r&0xff00
+		case WidthHi:
+			*r = value<<8 | *r&0xff
+		}
+		return memAccess{}, false
+	case operandDisp:
+		seg, offset := regs[dst.disp.Segment()], dispOffset(regs, dst.disp)
+		a := memAccess{seg: seg, offset: offset, word: word, write: true}
+		a.old = mem.Read(seg, offset, word)
+		mem.Write(seg, offset, value, word)
+		a.new = mem.Read(seg, offset, word)
+		return a, true
+	}
+	panic(dst)
+}
+
+// Pushes the word onto the stack at ss:sp. The write is returned so that it
+// can be traced.
+func push(regs *Registers, mem *Memory, value uint16) memAccess {
+	regs[RegSp] -= 2
+	seg, offset := regs[RegSs], regs[RegSp]
+	a := memAccess{seg: seg, offset: offset, old: mem.Read(seg, offset, true), new: value, word: true, write: true}
+	mem.Write(seg, offset, value, true)
+	return a
+}
+
+// Returns the effective address of the operand, the offset into its segment.
+func dispOffset(regs *Registers, d OperandDisplacement) uint16 {
+	imm := uint16(d.Imm)
+	switch d.Kind {
+	case DispBxSi:
+		return regs[RegBx] + regs[RegSi] + imm
+	case DispBxDi:
+		return regs[RegBx] + regs[RegDi] + imm
+	case DispBpSi:
+		return regs[RegBp] + regs[RegSi] + imm
+	case DispBpDi:
+		return regs[RegBp] + regs[RegDi] + imm
+	case DispSi:
+		return regs[RegSi] + imm
+	case DispDi:
+		return regs[RegDi] + imm
+	case DispBp:
+		return regs[RegBp] + imm
+	case DispBx:
+		return regs[RegBx] + imm
+	case DispEA:
+		return imm
+	}
+	panic(d)
+}
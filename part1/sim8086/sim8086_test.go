@@ -0,0 +1,1473 @@
+package sim8086
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Must[T any](t T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func Must0(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// The listings in testdata, each assembled by NASM from the .asm file of the
+// same name.
+var listings = []string{
+	"listing_0037_single_register_mov",
+	"listing_0038_many_register_mov",
+	"listing_0039_more_movs",
+	"listing_0040_challenge_movs",
+	"listing_0041_add_sub_cmp_jnz",
+	"listing_0042_completionist_decode",
+	"listing_0043_immediate_movs",
+	"listing_0044_register_movs",
+	"listing_0045_challenge_register_movs",
+	"listing_0046_add_sub_cmp",
+	"listing_0047_challenge_flags",
+	"listing_0048_ip_register",
+	"listing_0049_conditional_jumps",
+	"listing_0050_challenge_jumps",
+	"listing_0051_memory_mov",
+	"listing_0052_memory_add_loop",
+	"listing_0053_add_loop_challenge",
+	"listing_0054_draw_rectangle",
+	"listing_0055_challenge_rectangle",
+	"stack_push_pop",
+	"stack_call_ret",
+	"stack_far_call",
+	"stack_int_iret",
+	"dos_hello",
+}
+
+func TestDisassemble(t *testing.T) {
+	for _, inputFile := range listings {
+		inputFile = path.Join("testdata", inputFile)
+		reassembleAndCompare(t, inputFile, DisasmOptions{})
+		reassembleAndCompare(t, inputFile, DisasmOptions{Labels: true})
+		reassembleAndCompare(t, inputFile, DisasmOptions{Labels: true, Recursive: true})
+	}
+}
+
+// The disassembly is cross-checked with NASM, when it is installed.
+func TestDisassembleNASM(t *testing.T) {
+	if _, err := exec.LookPath("nasm"); err != nil {
+		t.Skip("nasm is not installed")
+	}
+	outputFile := path.Join("testdata", "tmp_output_file")
+	outputFileAsm := outputFile + ".asm"
+	defer os.Remove(outputFile)
+	defer os.Remove(outputFileAsm)
+	for _, inputFile := range listings {
+		buf := Must(ioutil.ReadFile(path.Join("testdata", inputFile)))
+		for _, opts := range []DisasmOptions{{}, {Labels: true}} {
+			var sb strings.Builder
+			Disassemble(&sb, buf, opts)
+			Must0(ioutil.WriteFile(outputFileAsm, []byte(sb.String()), 0o644))
+			Must0(exec.Command("nasm", outputFileAsm).Run())
+			if ref := Must(ioutil.ReadFile(outputFile)); !bytes.Equal(buf, ref) {
+				t.Errorf("Listing %s did not reassemble with nasm to expected output (%+v)", inputFile, opts)
+			}
+		}
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	for _, inputFile := range listings {
+		inputFile = path.Join("testdata", inputFile)
+		src := Must(ioutil.ReadFile(inputFile + ".asm"))
+		want := Must(ioutil.ReadFile(inputFile))
+		got, err := Assemble(string(src))
+		if err != nil {
+			t.Errorf("%s: %v", inputFile, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got\n% x\nwant\n% x", inputFile, got, want)
+		}
+	}
+}
+
+func TestAssembleJumps(t *testing.T) {
+	for i, tc := range []struct {
+		src  string
+		want []byte
+	}{
+		// A jmp is short unless its target is out of reach.
+		{"jmp end\nend:", []byte{0xeb, 0x00}},
+		{"jmp end\npad:\ndb " + strings.Repeat("0, ", 127) + "0\nend:", append([]byte{0xe9, 0x80, 0x00}, make([]byte, 128)...)},
+		{"jmp near $", []byte{0xe9, 0xfd, 0xff}},
+		{"jne $-19", []byte{0x75, 0xeb}},
+		{"call $+5\nloop $", []byte{0xe8, 0x02, 0x00, 0xe2, 0xfe}},
+		{"org 0x100\njmp 0x100\ncall 0x100", []byte{0xeb, 0xfe, 0xe8, 0xfb, 0xff}},
+		{"start: mov dx, msg\nmsg: db 'hi', 10", []byte{0xba, 0x03, 0x00, 'h', 'i', 10}},
+		{"rep cs movsb\nmov al, es:[bp]\nmov ax, [ds:label+2]\nlabel:", []byte{0xf3, 0x2e, 0xa4, 0x26, 0x8a, 0x46, 0x00, 0x3e, 0xa1, 0x0d, 0x00}},
+	} {
+		got, err := Assemble(tc.src)
+		if err != nil || !bytes.Equal(got, tc.want) {
+			t.Errorf("test case %d: got % x, %v, want % x", i, got, err, tc.want)
+		}
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	for i, tc := range []struct {
+		src  string
+		line int
+		err  error
+	}{
+		{"bits 32", 1, ErrSyntax},
+		{"nop\nfoo ax", 2, ErrSyntax},
+		{"mov ax, [bx+bp]", 1, ErrSyntax},
+		{"mov ax, [si-bx]", 1, ErrSyntax},
+		{"mov ax, (1", 1, ErrSyntax},
+		{"x:\nx:", 2, ErrSyntax},
+		{"jmp nowhere", 1, ErrUndefinedLabel},
+		{"je far_away\ndb " + strings.Repeat("0, ", 200) + "0\nfar_away:", 1, ErrJumpOutOfRange},
+		{"jmp short $+200", 1, ErrJumpOutOfRange},
+		{"mov al, bx", 1, ErrInvalidOperands},
+		{"mov [bx], 1", 1, ErrInvalidOperands},
+		{"add cs, ax", 1, ErrInvalidOperands},
+		{"mov al, 256", 1, ErrInvalidOperands},
+		{"push al", 1, ErrInvalidOperands},
+		{"shl ax, 2", 1, ErrInvalidOperands},
+		{"lea ax, bx", 1, ErrInvalidOperands},
+		{"int 0x100", 1, ErrInvalidOperands},
+	} {
+		_, err := Assemble(tc.src)
+		var asmErr *AsmError
+		if !errors.Is(err, tc.err) || !errors.As(err, &asmErr) || asmErr.Line != tc.line {
+			t.Errorf("test case %d: got error \"%v\", want \"%v\" on line %d", i, err, tc.err, tc.line)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	for _, inputFile := range listings {
+		buf := Must(ioutil.ReadFile(path.Join("testdata", inputFile)))
+		for _, l := range decodeLines(buf) {
+			if l.data != nil {
+				continue
+			}
+			want := buf[l.ip : l.ip+l.in.Size]
+			if got := Encode(l.in); !bytes.Equal(got, want) {
+				t.Errorf("%s: %s encoded to % x, want % x", inputFile, l.in, got, want)
+			}
+			// NASM assembled the listings, so the encoding it would pick
+			// is the original one.
+			in := l.in
+			in.form = encodingForm{}
+			if got := Encode(in); !bytes.Equal(got, want) {
+				t.Errorf("%s: %s encoded to % x without its form, want % x", inputFile, l.in, got, want)
+			}
+		}
+	}
+}
+
+// Seeds a fuzz target with the machine code of every listing.
+func addListings(f *testing.F) {
+	for _, inputFile := range listings {
+		f.Add(Must(ioutil.ReadFile(path.Join("testdata", inputFile))))
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	addListings(f)
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		for ip := 0; ip < len(buf); {
+			in, advance, err := DecodeInstruction(buf, ip)
+			if err != nil {
+				ip++
+				continue
+			}
+			_ = in.String()
+			if got, want := Encode(in), buf[ip:ip+advance]; !bytes.Equal(got, want) {
+				t.Fatalf("offset %d: %s encoded to % x, want % x", ip, in, got, want)
+			}
+			ip += advance
+		}
+	})
+}
+
+func FuzzSimulate(f *testing.F) {
+	addListings(f)
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		// Keep only the instructions that decode, so that the program is a
+		// valid instruction stream at least until it modifies itself.
+		var code []byte
+		for ip := 0; ip < len(buf) && len(code) < 0x1000; {
+			in, advance, err := DecodeInstruction(buf, ip)
+			if err != nil {
+				ip++
+				continue
+			}
+			code = append(code, Encode(in)...)
+			ip += advance
+		}
+		m := Must(NewMachine(code, SimOptions{}))
+		for i := 0; i < 1000 && !m.Halted; i++ {
+			step, err := m.Step()
+			if err != nil {
+				return
+			}
+			if m.Executed != i+1 {
+				t.Fatalf("%s: executed %d instructions, want %d", step.Instruction, m.Executed, i+1)
+			}
+			if flags := m.Regs[RegFlags]; flags&^allFlags != 0 {
+				t.Fatalf("%s: flags %#04x set outside of %#04x", step.Instruction, flags, allFlags)
+			}
+			if transfersControl(step.Instruction) {
+				continue
+			}
+			if got, want := step.Regs[RegIp], step.Prev[RegIp]+uint16(step.Instruction.Size); got != want {
+				t.Fatalf("%s: ip 0x%x, want 0x%x", step.Instruction, got, want)
+			}
+		}
+	})
+}
+
+// Reports whether the instruction can continue somewhere other than after
+// itself.
+func transfersControl(in Instruction) bool {
+	switch in.Op {
+	case OpCall, OpJmp, OpRet, OpRetf, OpInt, OpInt3, OpInto, OpIret:
+		return true
+	}
+	return in.IsRelJump()
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for i, tc := range []struct {
+		input  []byte
+		ip     int
+		err    error
+		offset int
+	}{
+		{[]byte{0x89}, 0, ErrTruncated, 0},
+		{[]byte{0x90, 0xb8, 0x01}, 1, ErrTruncated, 1},
+		{[]byte{0x90, 0xf3, 0x2e}, 1, ErrTruncated, 1},
+		{[]byte{0x60}, 0, ErrUnknownOpcode, 0},
+		{[]byte{0x90, 0xf0, 0xfe, 0xd0}, 1, ErrUnknownOpcode, 1},
+		{[]byte{0x8c, 0x20}, 0, ErrIllegalEncoding, 0},
+		{[]byte{0x8d, 0xc0}, 0, ErrIllegalEncoding, 0},
+		{[]byte{0xff, 0xd8}, 0, ErrIllegalEncoding, 0},
+	} {
+		_, _, err := DecodeInstruction(tc.input, tc.ip)
+		var decodeErr *DecodeError
+		if !errors.Is(err, tc.err) || !errors.As(err, &decodeErr) {
+			t.Errorf("test case %d: got error \"%v\", want \"%v\"", i, err, tc.err)
+		} else if decodeErr.Offset != tc.offset {
+			t.Errorf("test case %d: got offset %d, want %d", i, decodeErr.Offset, tc.offset)
+		}
+	}
+}
+
+func TestOpcodeTable(t *testing.T) {
+	for b1 := 0; b1 < 0x100; b1++ {
+		for b2 := 0; b2 < 0x100; b2++ {
+			got, want := lookupOperation(byte(b1), byte(b2)), operation(byte(b1), byte(b2))
+			if got != want {
+				t.Errorf("%02x %02x: got %v, want %v", b1, b2, got, want)
+			}
+		}
+	}
+}
+
+func TestDecodeAllocs(t *testing.T) {
+	code := []byte{0x26, 0x89, 0x40, 0x02} // mov [es:bx+si+2], ax
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, _, err := DecodeInstruction(code, 0); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocations, want 0", allocs)
+	}
+}
+
+func TestDisassembleData(t *testing.T) {
+	var sb strings.Builder
+	Disassemble(&sb, []byte{0x60, 0x61, 0x90, 0xb8, 0x01}, DisasmOptions{})
+	expected := "bits 16\n\ndb 0x60, 0x61\nxchg ax, ax\ndb 0xb8, 0x01\n"
+	if sb.String() != expected {
+		t.Errorf("got\n\n%s\nbut expected\n\n%s", sb.String(), expected)
+	}
+}
+
+func TestDisassembleRecursive(t *testing.T) {
+	code := Must(Assemble(`
+		jmp start
+	table:
+		db 0xb8, 0x01, 0x60
+	start:
+		mov bx, table
+		jne skip
+		mov ax, 0x4c00
+		int 0x21
+		db "hi"
+	skip:
+		call near [bx]
+		int 0x20
+		db 0xc3
+	`))
+	var sb strings.Builder
+	Disassemble(&sb, code, DisasmOptions{Labels: true, Recursive: true})
+	expected := `bits 16
+
+jmp label_0005
+db 0xb8, 0x01, 0x60
+label_0005:
+mov bx, 2
+jne label_0011
+mov ax, 19456
+int 33
+db 0x68, 0x69
+label_0011:
+call word [bx+0]
+int 32
+db 0xc3
+`
+	if sb.String() != expected {
+		t.Errorf("got\n\n%s\nbut expected\n\n%s", sb.String(), expected)
+	}
+	if ref, err := Assemble(sb.String()); err != nil || !bytes.Equal(ref, code) {
+		t.Errorf("did not reassemble to the original code: %v", err)
+	}
+}
+
+func TestDisassembleLabels(t *testing.T) {
+	var sb strings.Builder
+	// jne back to the start, a jump forward to the end of the buffer, and a
+	// jump into the middle of an instruction which keeps its offset.
+	buf := []byte{0x90, 0x75, 0xfd, 0xeb, 0x05, 0xb8, 0x01, 0x00, 0xeb, 0xfc}
+	Disassemble(&sb, buf, DisasmOptions{Labels: true})
+	expected := `bits 16
+
+label_0000:
+xchg ax, ax
+jne label_0000
+jmp label_000a
+mov ax, 1
+jmp $-2
+label_000a:
+`
+	if sb.String() != expected {
+		t.Errorf("got\n\n%s\nbut expected\n\n%s", sb.String(), expected)
+	}
+}
+
+func reassembleAndCompare(t *testing.T, inputFile string, opts DisasmOptions) {
+	buf := Must(ioutil.ReadFile(inputFile))
+	var sb strings.Builder
+	Disassemble(&sb, buf, opts)
+	ref, err := Assemble(sb.String())
+	if err != nil {
+		t.Errorf("Listing %s did not reassemble (%+v): %v", inputFile, opts, err)
+	} else if !bytes.Equal(buf, ref) {
+		t.Errorf("Listing %s did not reassemble to expected output (%+v)", inputFile, opts)
+	}
+}
+
+func TestCFG(t *testing.T) {
+	code := Must(Assemble(`
+		mov cx, 3
+	top:
+		dec cx
+		jnz top
+		call f
+		jmp done
+	f:
+		ret
+		db 0x60
+	done:
+		mov ax, 1
+	`))
+	type block struct {
+		start, end, n int
+		succs         []Edge
+	}
+	want := []block{
+		{0x00, 0x03, 1, []Edge{{EdgeFallthrough, 0x03}}},
+		{0x03, 0x06, 2, []Edge{{EdgeTaken, 0x03}, {EdgeFallthrough, 0x06}}},
+		{0x06, 0x09, 1, []Edge{{EdgeTaken, 0x0b}, {EdgeFallthrough, 0x09}}},
+		{0x09, 0x0b, 1, []Edge{{EdgeTaken, 0x0d}}},
+		{0x0b, 0x0c, 1, nil},
+		{0x0c, 0x0d, 0, nil},
+		{0x0d, 0x10, 1, nil},
+	}
+	g := BuildCFG(code)
+	var got []block
+	for _, b := range g.Blocks {
+		got = append(got, block{b.Start, b.End, len(b.Instructions), b.Succs})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got blocks\n%+v\nwant\n%+v", got, want)
+	}
+
+	var sb strings.Builder
+	BuildCFG(code[:0x09]).WriteDOT(&sb)
+	wantDOT := `digraph cfg {
+	node [shape=box, fontname="monospace"];
+	label_0000 [label="label_0000:\lmov cx, 3\l"];
+	label_0003 [label="label_0003:\ldec cx\ljne label_0003\l"];
+	label_0006 [label="label_0006:\lcall $+5\l"];
+	label_0000 -> label_0003 [style=dashed];
+	label_0003 -> label_0003;
+	label_0003 -> label_0006 [style=dashed];
+}
+`
+	if sb.String() != wantDOT {
+		t.Errorf("got DOT\n%s\nwant\n%s", sb.String(), wantDOT)
+	}
+}
+
+// The listings that TestSimulate runs, with their final registers.
+var simulateTests = []struct {
+	file     string
+	expected Registers
+}{
+	{"listing_0043_immediate_movs", Registers{
+		1, 2, 3, 4, 5, 6, 7, 8, RegIp: 24,
+	}},
+	{"listing_0044_register_movs", Registers{
+		4, 3, 2, 1, 1, 2, 3, 4, RegIp: 28,
+	}},
+	{"listing_0045_challenge_register_movs", Registers{
+		RegAx: 0x4411,
+		RegBx: 0x3344,
+		RegCx: 0x6677,
+		RegDx: 0x7788,
+		RegSp: 0x4411,
+		RegBp: 0x3344,
+		RegSi: 0x6677,
+		RegDi: 0x7788,
+		RegEs: 0x6677,
+		RegSs: 0x4411,
+		RegDs: 0x3344,
+		RegIp: 44,
+	}},
+	{"listing_0046_add_sub_cmp", Registers{
+		RegBx:    57602,
+		RegCx:    3841,
+		RegSp:    998,
+		RegIp:    24,
+		RegFlags: FlagP | FlagZ,
+	}},
+	{"listing_0047_challenge_flags", Registers{
+		RegBx:    40101,
+		RegDx:    10,
+		RegSp:    99,
+		RegBp:    98,
+		RegIp:    44,
+		RegFlags: FlagC | FlagA | FlagP | FlagS,
+	}},
+	{"listing_0048_ip_register", Registers{
+		RegBx:    2000,
+		RegCx:    64736,
+		RegIp:    14,
+		RegFlags: FlagC | FlagS,
+	}},
+	{"listing_0049_conditional_jumps", Registers{
+		RegBx:    1030,
+		RegIp:    14,
+		RegFlags: FlagP | FlagZ,
+	}},
+	{"listing_0050_challenge_jumps", Registers{
+		RegAx:    13,
+		RegBx:    65531,
+		RegIp:    28,
+		RegFlags: FlagC | FlagA | FlagS,
+	}},
+	{"listing_0051_memory_mov", Registers{
+		RegBx: 1,
+		RegCx: 2,
+		RegDx: 10,
+		RegBp: 4,
+		RegIp: 48,
+	}},
+	{"listing_0052_memory_add_loop", Registers{
+		RegBx:    6,
+		RegCx:    4,
+		RegDx:    6,
+		RegBp:    1000,
+		RegSi:    6,
+		RegIp:    35,
+		RegFlags: FlagP | FlagZ,
+	}},
+	{"listing_0053_add_loop_challenge", Registers{
+		RegBx:    6,
+		RegDx:    6,
+		RegBp:    998,
+		RegIp:    33,
+		RegFlags: FlagP | FlagZ,
+	}},
+	{"listing_0054_draw_rectangle", Registers{
+		RegCx:    64,
+		RegDx:    64,
+		RegBp:    16640,
+		RegIp:    38,
+		RegFlags: FlagP | FlagZ,
+	}},
+	{"listing_0055_challenge_rectangle", Registers{
+		RegBx: 16388,
+		RegBp: 764,
+		RegIp: 68,
+	}},
+	{"stack_push_pop", Registers{
+		RegAx:    0xfe,
+		RegBx:    0x5678,
+		RegCx:    0x5678,
+		RegDx:    0x1234,
+		RegSp:    256,
+		RegBp:    0xf003,
+		RegSi:    0x3000,
+		RegDi:    0xabcd,
+		RegEs:    0x3000,
+		RegIp:    43,
+		RegFlags: FlagA | FlagZ | FlagI | FlagD,
+	}},
+	{"stack_call_ret", Registers{
+		RegAx: 11,
+		RegBx: 37,
+		RegCx: 11,
+		RegSp: 256,
+		RegBp: 252,
+		RegIp: 49,
+	}},
+	{"stack_far_call", Registers{
+		RegAx:    20,
+		RegDx:    1,
+		RegSp:    256,
+		RegCs:    1,
+		RegIp:    21,
+		RegFlags: FlagP,
+	}},
+	{"stack_int_iret", Registers{
+		RegAx:    8,
+		RegBx:    0x8000,
+		RegCx:    0xf002,
+		RegSp:    256,
+		RegIp:    61,
+		RegFlags: FlagP | FlagA | FlagS | FlagI | FlagO,
+	}},
+}
+
+func TestSimulate(t *testing.T) {
+	for _, tc := range simulateTests {
+		buf := Must(ioutil.ReadFile(path.Join("testdata", tc.file)))
+		// Both engines must produce the same trace.
+		var traces [2]strings.Builder
+		for i, opts := range []SimOptions{{}, {Predecode: true}} {
+			regs, _, err := Simulate(&traces[i], buf, opts)
+			if err != nil {
+				t.Errorf("Listing %s failed (predecode %v): %v", tc.file, opts.Predecode, err)
+			} else if regs != tc.expected {
+				t.Errorf("Listing %s failed (predecode %v), got\n\n%s\nbut expected\n\n%s\n", tc.file, opts.Predecode, regs.Summary(), tc.expected.Summary())
+			}
+		}
+		if traces[0].String() != traces[1].String() {
+			t.Errorf("Listing %s: predecoded trace\n%s\ndiffers from\n%s", tc.file, traces[1].String(), traces[0].String())
+		}
+	}
+}
+
+func TestEstimateClocks(t *testing.T) {
+	for i, tc := range []struct {
+		input  []byte
+		regs   Registers
+		taken  bool
+		clocks [2]Clocks // 8086 and 8088
+	}{
+		// mov bx, 1000
+		{[]byte{0xbb, 0xe8, 0x03}, Registers{}, false, [2]Clocks{{4, 0, 0}, {4, 0, 0}}},
+		// add cx, [bp+0]
+		{[]byte{0x03, 0x4e, 0x00}, Registers{RegBp: 1000}, false, [2]Clocks{{9, 9, 0}, {9, 9, 4}}},
+		// mov ax, [0] and mov [1000], ax take no EA time
+		{[]byte{0xa1, 0x00, 0x00}, Registers{}, false, [2]Clocks{{10, 0, 0}, {10, 0, 4}}},
+		{[]byte{0xa3, 0xe8, 0x03}, Registers{}, false, [2]Clocks{{10, 0, 0}, {10, 0, 4}}},
+		// rep movsw, two word transfers for every repetition
+		{[]byte{0xf3, 0xa5}, Registers{RegCx: 10}, false, [2]Clocks{{179, 0, 0}, {179, 0, 80}}},
+		// mov ax, [bx+0] with an encoded displacement
+		{[]byte{0x8b, 0x47, 0x00}, Registers{}, false, [2]Clocks{{8, 9, 0}, {8, 9, 4}}},
+		// mov [bx+1], cx
+		{[]byte{0x89, 0x4f, 0x01}, Registers{}, false, [2]Clocks{{9, 9, 4}, {9, 9, 4}}},
+		// mov al, [bx+si]
+		{[]byte{0x8a, 0x00}, Registers{RegBx: 1}, false, [2]Clocks{{8, 7, 0}, {8, 7, 0}}},
+		// add ax, [es:1000]
+		{[]byte{0x26, 0x03, 0x06, 0xe8, 0x03}, Registers{}, false, [2]Clocks{{9, 8, 0}, {9, 8, 4}}},
+		// add word [bx+di+2], 5
+		{[]byte{0x83, 0x41, 0x02, 0x05}, Registers{RegDi: 1}, false, [2]Clocks{{17, 12, 8}, {17, 12, 8}}},
+		// shl ax, cl
+		{[]byte{0xd3, 0xe0}, Registers{RegCx: 3}, false, [2]Clocks{{20, 0, 0}, {20, 0, 0}}},
+		// je
+		{[]byte{0x74, 0x02}, Registers{}, true, [2]Clocks{{16, 0, 0}, {16, 0, 0}}},
+		{[]byte{0x74, 0x02}, Registers{}, false, [2]Clocks{{4, 0, 0}, {4, 0, 0}}},
+	} {
+		in, _, err := DecodeInstruction(tc.input, 0)
+		if err != nil {
+			t.Fatalf("test case %d: %v", i, err)
+		}
+		for j, cpu := range []CPU{CPU8086, CPU8088} {
+			clocks := EstimateClocks(cpu, in, &tc.regs, tc.taken)
+			if clocks != tc.clocks[j] {
+				t.Errorf("test case %d (%s, %s): got %+v, want %+v", i, in, cpu, clocks, tc.clocks[j])
+			}
+		}
+	}
+}
+
+func TestSimulateEndOfProgram(t *testing.T) {
+	buf := []byte{0x40} // inc ax
+	m := Must(NewMachine(buf, SimOptions{}))
+	Must(m.Step())
+	if !m.Halted || m.Regs[RegIp] != 1 {
+		t.Errorf("did not halt at the end of the program:\n%s", m.Regs.Summary())
+	}
+	if m.Mem[1] != 0 {
+		t.Errorf("got %#x after the program, want 0", m.Mem[1])
+	}
+	if _, err := m.Step(); !errors.Is(err, ErrEndOfProgram) || m.Executed != 1 {
+		t.Errorf("got error \"%v\" after %d instructions, want \"%v\" after 1", err, m.Executed, ErrEndOfProgram)
+	}
+	// An empty program ends before it starts.
+	m = Must(NewMachine(nil, SimOptions{}))
+	var sb strings.Builder
+	Must0(m.RunJSON(&sb))
+	if sb.Len() != 0 || m.Executed != 0 {
+		t.Errorf("got trace %q of an empty program", sb.String())
+	}
+}
+
+func TestSimulateMemoryArithmetic(t *testing.T) {
+	buf := []byte{
+		0xbb, 0xe8, 0x03, // mov bx, 1000
+		0xc7, 0x07, 0x05, 0x00, // mov word [bx], 5
+		0x83, 0x07, 0x04, // add word [bx], 4
+		0xc6, 0x47, 0x02, 0x01, // mov byte [bx+2], 1
+		0x80, 0x7f, 0x02, 0x00, // cmp byte [bx+2], 0
+		0x2b, 0x07, // sub ax, [bx]
+	}
+	var sb strings.Builder
+	regs, mem, err := Simulate(&sb, buf, SimOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Registers{
+		RegAx:    0xfff7,
+		RegBx:    1000,
+		RegIp:    20,
+		RegFlags: FlagC | FlagA | FlagS,
+	}
+	if regs != expected {
+		t.Errorf("got\n\n%s\nbut expected\n\n%s\n", regs.Summary(), expected.Summary())
+	}
+	if mem[1000] != 9 || mem[1001] != 0 || mem[1002] != 1 {
+		t.Errorf("unexpected memory contents % x", mem[1000:1003])
+	}
+	if trace := sb.String(); !strings.Contains(trace, "[0x3e8]:0x5->0x9") {
+		t.Errorf("memory write missing from trace:\n%s", trace)
+	}
+}
+
+// A single instruction test in the format of the public 8086/8088 single
+// step test suites: the state before and after executing one instruction.
+// The final registers only include the ones that changed. The files in
+// testdata/vectors are named after the opcode, and the REG field for group
+// opcodes, like those of the suites, so that their files can be dropped in
+// there too.
+type testVector struct {
+	Name    string      `json:"name"`
+	Bytes   []int       `json:"bytes"`
+	Initial vectorState `json:"initial"`
+	Final   vectorState `json:"final"`
+}
+
+type vectorState struct {
+	Regs map[string]uint16 `json:"regs"`
+	RAM  [][2]int          `json:"ram"`
+}
+
+func loadVectors(file string) ([]testVector, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	}
+	var vectors []testVector
+	err = json.NewDecoder(r).Decode(&vectors)
+	return vectors, err
+}
+
+// Returns the flags that the instruction leaves undefined, which may differ
+// between the simulator and the processor.
+func undefinedFlags(in Instruction) Flags {
+	switch in.Op {
+	case OpAnd, OpOr, OpXor, OpTest:
+		return FlagA
+	case OpMul, OpImul:
+		return FlagS | FlagZ | FlagA | FlagP
+	case OpDiv, OpIdiv:
+		return arithFlags
+	case OpShl, OpShr, OpSar, OpRol, OpRor, OpRcl, OpRcr:
+		var undefined Flags
+		// Overflow is only defined for shifts by one.
+		if in.Operands()[1].Op() == (OperandReg{RegCx, WidthLo}) {
+			undefined |= FlagO
+		}
+		if in.Op == OpShl || in.Op == OpShr || in.Op == OpSar {
+			undefined |= FlagA
+		}
+		return undefined
+	case OpDaa, OpDas:
+		return FlagO
+	case OpAaa, OpAas:
+		return FlagO | FlagS | FlagZ | FlagP
+	case OpAam, OpAad:
+		return FlagO | FlagA | FlagC
+	}
+	return 0
+}
+
+func TestVectors(t *testing.T) {
+	files := Must(filepath.Glob("testdata/vectors/*.json*"))
+	if len(files) == 0 {
+		t.Fatal("no test vectors")
+	}
+	regs := map[string]Register{"flags": RegFlags}
+	for r := RegAx; r < RegFlags; r++ {
+		regs[OperandReg{r, WidthFull}.String()] = r
+	}
+	for _, file := range files {
+		vectors, err := loadVectors(file)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		for i, v := range vectors {
+			m := &Machine{Mem: new(Memory)}
+			for name, value := range v.Initial.Regs {
+				m.Regs[regs[name]] = value
+			}
+			// The reserved bits of the flags are not simulated.
+			m.Regs[RegFlags] &= allFlags
+			for _, a := range v.Initial.RAM {
+				m.Mem[a[0]] = byte(a[1])
+			}
+			want := m.Regs
+			for name, value := range v.Final.Regs {
+				want[regs[name]] = value
+			}
+			step, err := m.Step()
+			if err != nil {
+				t.Errorf("%s: test %d (% x): %v", file, i, v.Bytes, err)
+				continue
+			}
+			for r := RegAx; r < RegFlags; r++ {
+				if m.Regs[r] != want[r] {
+					t.Errorf("%s: test %d (%s): %s is 0x%04x, want 0x%04x",
+						file, i, step.Instruction, OperandReg{r, WidthFull}, m.Regs[r], want[r])
+				}
+			}
+			defined := allFlags &^ undefinedFlags(step.Instruction)
+			for _, flag := range regFlags {
+				got, want := m.Regs[RegFlags]&flag != 0, want[RegFlags]&flag != 0
+				if defined&flag != 0 && got != want {
+					t.Errorf("%s: test %d (%s): flag %s is %t, want %t",
+						file, i, step.Instruction, FlagString(flag), got, want)
+				}
+			}
+			for _, a := range v.Final.RAM {
+				if got := m.Mem[a[0]]; got != byte(a[1]) {
+					t.Errorf("%s: test %d (%s): memory at 0x%05x is 0x%02x, want 0x%02x",
+						file, i, step.Instruction, a[0], got, a[1])
+				}
+			}
+		}
+	}
+}
+
+func TestSimulateSelfModifying(t *testing.T) {
+	buf := []byte{
+		0xc6, 0x06, 0x06, 0x00, 0x05, // mov byte [6], 5
+		0xb8, 0x01, 0x00, // mov ax, 1
+		0x8b, 0x1e, 0x00, 0x00, // mov bx, [0]
+		0xf4,             // hlt
+		0xb9, 0x01, 0x00, // mov cx, 1
+	}
+	for _, seg := range []uint16{0, 0x1234} {
+		regs, _, err := Simulate(io.Discard, buf, SimOptions{LoadSegment: seg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := Registers{
+			RegAx: 5,
+			RegBx: 0x06c6,
+			RegEs: seg,
+			RegCs: seg,
+			RegSs: seg,
+			RegDs: seg,
+			RegIp: 13,
+		}
+		if regs != expected {
+			t.Errorf("load segment 0x%x: got\n\n%s\nbut expected\n\n%s\n", seg, regs.Summary(), expected.Summary())
+		}
+	}
+}
+
+// The cached instruction is decoded again after the loop modifies it.
+func TestSimulatePredecodeInvalidation(t *testing.T) {
+	code := Must(Assemble(`
+		mov cx, 2
+	top:
+		mov ax, 1
+		mov byte [4], 7 ; the immediate of mov ax, 1
+		loop top
+	`))
+	for _, opts := range []SimOptions{{}, {Predecode: true}} {
+		regs, _, err := Simulate(io.Discard, code, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if regs[RegAx] != 7 {
+			t.Errorf("predecode %v: got ax %d, want 7", opts.Predecode, regs[RegAx])
+		}
+	}
+}
+
+func TestSimulateStringAndTransfer(t *testing.T) {
+	code := Must(Assemble(`
+		mov si, src
+		mov di, 200
+		mov cx, 4
+		rep movsb
+		mov si, src
+		mov di, 200
+		mov cx, 4
+		repe cmpsb
+		mov di, src
+		mov al, 'c'
+		mov cx, 4
+		repne scasb
+		mov bx, table
+		mov al, 2
+		xlat
+		lea bp, [bx+di+2]
+		mov dx, 0x1122
+		xchg ax, dx
+		les di, [far]
+		mov si, src
+		std
+		lodsw
+		in al, 0x60
+		out 0x20, al
+		hlt
+	src:
+		db 'abcd'
+	table:
+		db 10, 20, 30
+	far:
+		dw 0x1234, 0x5678
+	`))
+	src := bytes.Index(code, []byte("abcd"))
+	for _, predecode := range []bool{false, true} {
+		regs, mem, err := Simulate(io.Discard, code, SimOptions{Predecode: predecode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(mem[200:204]); got != "abcd" {
+			t.Errorf("predecode %v: movs copied %q, want \"abcd\"", predecode, got)
+		}
+		table := uint16(src + 4)
+		want := Registers{
+			// lodsw loads "ab" and in loads 0xff into al.
+			RegAx: 'b'<<8 | 0xff,
+			RegBx: table,
+			// Repne scasb stops after the 'c', one short of the end.
+			RegCx:    1,
+			RegDx:    30,
+			RegBp:    table + uint16(src) + 3 + 2,
+			RegSi:    uint16(src) - 2,
+			RegDi:    0x1234,
+			RegEs:    0x5678,
+			RegIp:    uint16(src),
+			RegFlags: FlagD | FlagP | FlagZ,
+		}
+		if regs != want {
+			t.Errorf("predecode %v: got\n\n%s\nbut expected\n\n%s\n", predecode, regs.Summary(), want.Summary())
+		}
+	}
+}
+
+// Every operation the decoder knows is executed, none falls through as a
+// nop.
+func TestSimulateImplemented(t *testing.T) {
+	for o, e := range encodings {
+		// A memory operand [bx], for the operations that take one.
+		code := []byte{e.opcode, e.reg<<3 | 0b111, 0, 0, 0, 0}
+		in, _, err := DecodeInstruction(code, 0)
+		if err != nil {
+			t.Fatalf("%v: %v", o, err)
+		}
+		m := Must(NewMachine(code, SimOptions{}))
+		if _, err := m.Step(); errors.Is(err, ErrUnimplemented) {
+			t.Errorf("%s: %v", in, err)
+		}
+	}
+}
+
+func TestSimulateSegments(t *testing.T) {
+	buf := []byte{
+		0xb8, 0x00, 0x10, // mov ax, 0x1000
+		0x8e, 0xd8, // mov ds, ax
+		0xc7, 0x06, 0x04, 0x00, 0x34, 0x12, // mov word [4], 0x1234
+		0xbd, 0x08, 0x00, // mov bp, 8
+		0xc6, 0x46, 0x00, 0x07, // mov byte [bp+0], 7
+		0x3e, 0xc6, 0x46, 0x01, 0x09, // mov byte [ds:bp+1], 9
+		0xc7, 0x06, 0xff, 0xff, 0xcd, 0xab, // mov word [65535], 0xabcd
+		0x26, 0x8b, 0x1e, 0x08, 0x00, // mov bx, word [es:8]
+	}
+	regs, mem, err := Simulate(io.Discard, buf, SimOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		addr  int
+		value byte
+	}{
+		{0x10004, 0x34},
+		{0x10005, 0x12},
+		{0x00008, 0x07},
+		{0x10009, 0x09},
+		{0x1ffff, 0xcd},
+		{0x10000, 0xab},
+	} {
+		if mem[tc.addr] != tc.value {
+			t.Errorf("memory at 0x%05x: got 0x%02x, want 0x%02x", tc.addr, mem[tc.addr], tc.value)
+		}
+	}
+	// The program is loaded at address 0, so the high byte is the 0x34 of
+	// the third instruction.
+	if regs[RegBx] != 0x3407 {
+		t.Errorf("bx: got 0x%x, want 0x3407", regs[RegBx])
+	}
+}
+
+func TestSimulateCOM(t *testing.T) {
+	for i, tc := range []struct {
+		image  []byte
+		output string
+		err    error
+	}{
+		{Must(ioutil.ReadFile(path.Join("testdata", "dos_hello"))), "Hello, world!\n", nil},
+		// Returning from the program jumps to the int 20h in the PSP.
+		{[]byte{
+			0xb0, 0x41, // mov al, 'A'
+			0xb4, 0x0e, // mov ah, 0x0e
+			0xcd, 0x10, // int 0x10
+			0xc3, // ret
+		}, "A", nil},
+		{[]byte{
+			0xb4, 0x30, // mov ah, 0x30
+			0xcd, 0x21, // int 0x21
+		}, "", ErrUnsupportedService},
+		{make([]byte, 0x10000), "", ErrImageTooLarge},
+	} {
+		var sb strings.Builder
+		opts := SimOptions{Interrupts: DOSServices(&sb)}
+		_, _, err := SimulateCOM(io.Discard, tc.image, opts)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("test case %d: got error \"%v\", want \"%v\"", i, err, tc.err)
+		}
+		if sb.String() != tc.output {
+			t.Errorf("test case %d: got output %q, want %q", i, sb.String(), tc.output)
+		}
+	}
+}
+
+func TestLoadCOM(t *testing.T) {
+	var mem Memory
+	regs, err := LoadCOM(&mem, []byte{0x90}, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Registers{
+		RegSp: 0xfffe,
+		RegEs: 0x1000,
+		RegCs: 0x1000,
+		RegSs: 0x1000,
+		RegDs: 0x1000,
+		RegIp: 0x100,
+	}
+	if regs != expected {
+		t.Errorf("got\n\n%s\nbut expected\n\n%s\n", regs.Summary(), expected.Summary())
+	}
+	if mem[0x10000] != 0xcd || mem[0x10001] != 0x20 || mem[0x10100] != 0x90 {
+		t.Errorf("unexpected memory contents % x ... % x", mem[0x10000:0x10002], mem[0x10100])
+	}
+}
+
+func TestDebug(t *testing.T) {
+	buf := Must(ioutil.ReadFile(path.Join("testdata", "stack_call_ret")))
+	m := Must(NewMachine(buf, SimOptions{}))
+	script := strings.Join([]string{
+		"break label_0029",
+		"continue",
+		"step",
+		"",
+		"set ah 1",
+		"set flags CZ",
+		"write 1000 0xaa 0xbb",
+		"dump 0:1000 2",
+		"delete 0x29",
+		"continue",
+		"frobnicate",
+		"quit",
+	}, "\n")
+	var sb strings.Builder
+	Must0(Debug(strings.NewReader(script), &sb, m, buf))
+	out := sb.String()
+	for _, expected := range []string{
+		"breakpoint hit\n=> #18 0000:0029 mov bp, sp\n",
+		"mov bp, sp ; Clocks: +2 = 189 | bp:0x0->0xfc ip:0x29->0x2b\n=> #19 0000:002b mov cx, word [bp+2]\n",
+		"=> #20 0000:002e ret 2\n",
+		"003e8: aa bb\n",
+		"program halted\n",
+		"unknown command \"frobnicate\"",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("output does not contain %q:\n%s", expected, out)
+		}
+	}
+	expected := Registers{
+		RegAx:    0x10b,
+		RegBx:    37,
+		RegCx:    11,
+		RegSp:    256,
+		RegBp:    252,
+		RegIp:    49,
+		RegFlags: FlagC | FlagZ,
+	}
+	if m.Regs != expected {
+		t.Errorf("got\n\n%s\nbut expected\n\n%s\n", m.Regs.Summary(), expected.Summary())
+	}
+	if m.Mem[1000] != 0xaa || m.Mem[1001] != 0xbb {
+		t.Errorf("unexpected memory contents % x", m.Mem[1000:1002])
+	}
+}
+
+func TestWatchpoints(t *testing.T) {
+	buf := Must(ioutil.ReadFile(path.Join("testdata", "listing_0051_memory_mov")))
+	opts := SimOptions{Watchpoints: []Watchpoint{
+		Must(ParseWatchpoint("w:0x3ec")),
+		Must(ParseWatchpoint("r:1002-1004:halt")),
+	}}
+	var sb strings.Builder
+	regs, _, err := Simulate(&sb, buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The read of [1002] halts after the instruction.
+	if regs[RegIp] != 0x28 || regs[RegCx] != 2 || regs[RegDx] != 0 {
+		t.Errorf("simulation did not halt after the watched read:\n%s", regs.Summary())
+	}
+	trace := sb.String()
+	for _, expected := range []string{
+		"; watchpoint w:0x003ec-0x003ed: write of [0x3ec] by mov word [1004], 3 at 0000:000c: 0x0->0x3\n",
+		"; watchpoint w:0x003ec-0x003ed: write of [0x3ec] by mov word [bx+4], 10 at 0000:001b: 0x3->0xa\n",
+		"| cx:0x0->0x2 ip:0x24->0x28\n; watchpoint r:0x003ea-0x003ec:halt: read of [0x3ea] by mov cx, word [1002] at 0000:0024: 0x2\n",
+	} {
+		if !strings.Contains(trace, expected) {
+			t.Errorf("trace does not contain %q:\n%s", expected, trace)
+		}
+	}
+
+	for i, tc := range []struct {
+		input string
+		err   bool
+	}{
+		{"rw:0x100-0x200:halt", false},
+		{"x:0x100", true},
+		{"r:0x100-0x100", true},
+		{"w:0x100:stop", true},
+		{"w", true},
+	} {
+		if _, err := ParseWatchpoint(tc.input); (err != nil) != tc.err {
+			t.Errorf("test case %d: got error \"%v\"", i, err)
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	buf := Must(ioutil.ReadFile(path.Join("testdata", "stack_call_ret")))
+	start := Must(NewMachine(buf, SimOptions{}))
+	m := Must(NewMachine(buf, SimOptions{Record: true}))
+	Must0(m.Run(io.Discard))
+	end := *m
+	endMem := *m.Mem
+
+	Must0(m.Goto(0))
+	if m.Regs != start.Regs || *m.Mem != *start.Mem || m.Clocks != 0 {
+		t.Errorf("going back to the start did not restore the initial state:\n%s", m.Regs.Summary())
+	}
+	Must0(m.Goto(end.Executed))
+	if m.Regs != end.Regs || *m.Mem != endMem || m.Clocks != end.Clocks {
+		t.Errorf("going forward to the end did not restore the final state:\n%s", m.Regs.Summary())
+	}
+
+	// Find the last write of the return address of call bx.
+	m.opts.Watchpoints = []Watchpoint{Must(ParseWatchpoint("w:0xfe-0x100"))}
+	hits, ok := m.ReverseContinue(nil)
+	if !ok || len(hits) != 1 || hits[0].in.String() != "push ax" {
+		t.Errorf("got hits %v, %v", hits, ok)
+	}
+	m.opts.Watchpoints = nil
+	hits, ok = m.ReverseContinue(map[int]bool{0x25: true})
+	if !ok || len(hits) != 0 || m.Regs[RegIp] != 0x25 || m.Regs[RegAx] != 8 {
+		t.Errorf("did not stop at the breakpoint:\n%s", m.Regs.Summary())
+	}
+	if _, ok := m.ReverseContinue(nil); ok || m.Executed != 0 {
+		t.Errorf("did not run out of journal at instruction %d", m.Executed)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	code := Must(Assemble(`
+		mov cx, 3
+	top:
+		add ax, cx
+		loop top
+	`))
+	// Both engines collect the same profile.
+	for _, predecode := range []bool{false, true} {
+		p := NewProfile()
+		if _, _, err := Simulate(io.Discard, code, SimOptions{Profile: p, Predecode: predecode}); err != nil {
+			t.Fatal(err)
+		}
+		if loop := p.Instructions[5]; loop == nil || loop.Count != 3 || loop.Taken != 2 {
+			t.Fatalf("got loop profile %+v, want 3 executions and 2 taken", loop)
+		}
+		var sb strings.Builder
+		p.WriteReport(&sb)
+		want := `Profile: 7 instructions, 52 clocks
+address     count      clocks        %   instruction
+0x00000         1           4   7.69 %   mov cx, 3
+0x00003         3           9  17.31 %   add ax, cx
+0x00005         3          39  75.00 %   loop $-2 ; taken 2 (66.67 %), not taken 1
+`
+		if sb.String() != want {
+			t.Errorf("got report\n%s\nwant\n%s", sb.String(), want)
+		}
+	}
+}
+
+// A branch to the next instruction is still taken.
+func TestSimulateTakenBranch(t *testing.T) {
+	code := []byte{0x75, 0x00} // jne $+2
+	for _, predecode := range []bool{false, true} {
+		p := NewProfile()
+		m := Must(NewMachine(code, SimOptions{Profile: p, Predecode: predecode}))
+		step := Must(m.Step())
+		if step.Clocks.Total() != 16 {
+			t.Errorf("got %d clocks, want 16 (predecode %v)", step.Clocks.Total(), predecode)
+		}
+		if jne := p.Instructions[0]; jne == nil || jne.Taken != 1 {
+			t.Errorf("got profile %+v, want taken 1 (predecode %v)", jne, predecode)
+		}
+	}
+}
+
+func TestTraceJSON(t *testing.T) {
+	code := Must(Assemble(`
+		mov bx, 1000
+		mov word [bx], 0x8000
+		add word [bx], 0x8000
+	`))
+	var trace strings.Builder
+	m := Must(NewMachine(code, SimOptions{}))
+	Must0(m.RunJSON(&trace))
+	want := []TraceRecord{
+		{0, 0, "bbe803", "mov bx, 1000", 4, map[string][2]uint16{"bx": {0, 1000}, "ip": {0, 3}}, nil, nil},
+		{0, 3, "c7070080", "mov word [bx+0], 32768", 15, map[string][2]uint16{"ip": {3, 7}}, nil,
+			[]MemoryWrite{{1000, 0, 0x8000, true}}},
+		{0, 7, "81070080", "add word [bx+0], 32768", 22, map[string][2]uint16{"ip": {7, 11}},
+			&FlagsChange{"", "CPZO"}, []MemoryWrite{{1000, 0x8000, 0, true}}},
+	}
+	dec := json.NewDecoder(strings.NewReader(trace.String()))
+	for i := range want {
+		var got TraceRecord
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("record %d: got %+v, want %+v", i, got, want[i])
+		}
+	}
+	if dec.More() {
+		t.Errorf("trace continues after the end of the program")
+	}
+
+	if d := Must(FirstDivergence(strings.NewReader(trace.String()), strings.NewReader(trace.String()))); d != nil {
+		t.Errorf("got divergence of a trace from itself: %s", d)
+	}
+	// The second trace computes different flags for the add and then ends.
+	lines := strings.SplitAfter(trace.String(), "\n")
+	other := lines[0] + lines[1] + strings.Replace(lines[2], `"new":"CPZO"`, `"new":"CPZ"`, 1)
+	d := Must(FirstDivergence(strings.NewReader(trace.String()), strings.NewReader(other)))
+	if d == nil || d.Step != 2 || !reflect.DeepEqual(d.Fields, []string{"flags"}) {
+		t.Errorf("got divergence %v, want flags at step 2", d)
+	}
+	d = Must(FirstDivergence(strings.NewReader(trace.String()), strings.NewReader(lines[0])))
+	if d == nil || d.Step != 1 || d.B != nil {
+		t.Errorf("got divergence %v, want end of trace b at step 1", d)
+	}
+}
+
+func TestTraceJSONCOM(t *testing.T) {
+	buf := Must(ioutil.ReadFile(path.Join("testdata", "dos_hello")))
+	var trace, output strings.Builder
+	m := Must(NewCOMMachine(buf, SimOptions{Interrupts: DOSServices(&output)}))
+	Must0(m.RunJSON(&trace))
+	if !strings.HasPrefix(output.String(), "Hello") {
+		t.Errorf("got output %q", output.String())
+	}
+	for i, line := range strings.Split(strings.TrimSuffix(trace.String(), "\n"), "\n") {
+		var r TraceRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("record %d: %v: %q", i, err, line)
+		}
+	}
+	if d := Must(FirstDivergence(strings.NewReader(trace.String()), strings.NewReader(trace.String()))); d != nil {
+		t.Errorf("got divergence of a trace from itself: %s", d)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	buf := Must(ioutil.ReadFile(path.Join("testdata", "listing_0055_challenge_rectangle")))
+	want := Must(NewMachine(buf, SimOptions{CPU: CPU8088, LoadSegment: 0x100}))
+	for i := 0; i < 10; i++ {
+		Must(want.Step())
+	}
+
+	var b bytes.Buffer
+	Must0(want.SaveState(&b))
+	m := Must(LoadState(&b, SimOptions{}))
+	if m.Regs != want.Regs || *m.Mem != *want.Mem || m.Clocks != want.Clocks || m.Executed != 10 {
+		t.Errorf("loaded state differs from the saved one:\n%s", m.Regs.Summary())
+	}
+	if !reflect.DeepEqual(m.opts, want.opts) {
+		t.Errorf("got options %+v, want %+v", m.opts, want.opts)
+	}
+
+	// The loaded machine continues where the saved one stopped.
+	Must0(want.Run(io.Discard))
+	Must0(m.Run(io.Discard))
+	if m.Regs != want.Regs || *m.Mem != *want.Mem || m.Clocks != want.Clocks {
+		t.Errorf("got final registers\n%s\nwant\n%s", m.Regs.Summary(), want.Regs.Summary())
+	}
+
+	b.Reset()
+	Must0(m.SaveState(&b))
+	snap := b.Bytes()
+	badCPU := bytes.Clone(snap)
+	badCPU[10] = byte(len(cpuStrs)) // cpu follows the magic and version
+	for i, test := range []struct {
+		snap []byte
+		err  error
+	}{
+		{nil, ErrBadSnapshot},
+		{[]byte("8086SNAQ\x01\x00"), ErrBadSnapshot},
+		{append([]byte("8086SNAP\x02\x00"), snap[10:]...), ErrSnapshotVersion},
+		{snap[:len(snap)-1], ErrBadSnapshot},
+		{badCPU, ErrBadSnapshot},
+	} {
+		if _, err := LoadState(bytes.NewReader(test.snap), SimOptions{}); !errors.Is(err, test.err) {
+			t.Errorf("test case %d: got error \"%v\", want \"%v\"", i, err, test.err)
+		}
+	}
+}
+
+func TestFramebuffer(t *testing.T) {
+	for _, name := range []string{"listing_0054_draw_rectangle", "listing_0055_challenge_rectangle"} {
+		buf := Must(ioutil.ReadFile(path.Join("testdata", name)))
+		_, mem, err := Simulate(io.Discard, buf, SimOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := Must(DefaultFramebuffer.Image(mem))
+		f := Must(os.Open(path.Join("testdata", name+".png")))
+		want := Must(png.Decode(f))
+		f.Close()
+		if got.Bounds() != want.Bounds() {
+			t.Fatalf("%s: got bounds %v, want %v", name, got.Bounds(), want.Bounds())
+		}
+	pixels:
+		for y := 0; y < want.Bounds().Dy(); y++ {
+			for x := 0; x < want.Bounds().Dx(); x++ {
+				g := color.NRGBAModel.Convert(got.At(x, y))
+				w := color.NRGBAModel.Convert(want.At(x, y))
+				if g != w {
+					t.Errorf("%s: pixel (%d, %d): got %v, want %v", name, x, y, g, w)
+					break pixels
+				}
+			}
+		}
+	}
+
+	mem := new(Memory)
+	copy(mem[0x10:], []byte{0, 0x80, 0xff, 0x10})
+	img := Must(Must(ParseFramebuffer("indexed:0x10:2x2")).Image(mem))
+	if c := img.At(1, 0); c != (color.Gray{0x80}) {
+		t.Errorf("got indexed pixel %v, want gray 0x80", c)
+	}
+
+	for i, test := range []struct {
+		s   string
+		err error
+	}{
+		{"rgba:0x100:64x64", nil},
+		{"rgb:0x100:64x64", ErrBadFramebuffer},
+		{"rgba:0x100:64", ErrBadFramebuffer},
+		{"rgba:0x100:0x64", ErrBadFramebuffer},
+		{"rgba:0xfffff:2x1", ErrBadFramebuffer},
+		{"indexed:0xfffff:1x1", nil},
+	} {
+		if _, err := ParseFramebuffer(test.s); !errors.Is(err, test.err) {
+			t.Errorf("test case %d: got error \"%v\", want \"%v\"", i, err, test.err)
+		}
+	}
+}
+
+// The ways to look up operations, the switch and the opcode table built from
+// it, which is used when there is no lookup function.
+var lookups = []struct {
+	name string
+	fn   func(b1, b2 byte) OpDescr
+}{
+	{"switch", operation},
+	{"table", nil},
+}
+
+func BenchmarkDecodeInstruction(b *testing.B) {
+	// The listing has every kind of operation and addressing mode.
+	buf := Must(ioutil.ReadFile(path.Join("testdata", "listing_0042_completionist_decode")))
+	for _, l := range lookups {
+		b.Run(l.name, func(b *testing.B) {
+			b.SetBytes(int64(len(buf)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for ip := 0; ip < len(buf); {
+					_, advance, err := decodeInstruction(buf, ip, l.fn)
+					if err != nil {
+						b.Fatal(err)
+					}
+					ip += advance
+				}
+			}
+		})
+	}
+}
+
+// The opcode table against the switch it was built from.
+func BenchmarkOperation(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		fn   func(b1, b2 byte) OpDescr
+	}{
+		{"switch", operation},
+		{"table", lookupOperation},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			var o OpDescr
+			for i := 0; i < b.N; i++ {
+				o = bm.fn(byte(i), byte(i>>8))
+			}
+			_ = o
+		})
+	}
+}
+
+// A loop of 50000 instructions that read and write memory.
+const benchLoop = `
+	mov cx, 10000
+	mov bx, 1000
+top:
+	mov ax, [bx+si]
+	add ax, cx
+	mov [bx+si+2], ax
+	xor si, 2
+	loop top
+`
+
+// The interpreter decodes every instruction every time, the predecoded
+// engine executes them from its cache. Both run the listings of
+// TestSimulate.
+func BenchmarkStep(b *testing.B) {
+	for _, tc := range simulateTests {
+		buf := Must(ioutil.ReadFile(path.Join("testdata", tc.file)))
+		for _, bm := range []struct {
+			name string
+			opts SimOptions
+		}{
+			{"interpreter", SimOptions{}},
+			{"predecoded", SimOptions{Predecode: true}},
+		} {
+			b.Run(tc.file+"/"+bm.name, func(b *testing.B) {
+				b.ReportAllocs()
+				var executed int
+				for i := 0; i < b.N; i++ {
+					// Only the steps count, loading the listing into a new
+					// machine takes longer than running most of them.
+					b.StopTimer()
+					m := Must(NewMachine(buf, bm.opts))
+					b.StartTimer()
+					for !m.Halted {
+						Must(m.Step())
+					}
+					executed += m.Executed
+				}
+				b.ReportMetric(float64(executed)/b.Elapsed().Seconds(), "instructions/s")
+			})
+		}
+	}
+}
+
+func BenchmarkSimulate(b *testing.B) {
+	code := Must(Assemble(benchLoop))
+	for _, l := range lookups {
+		b.Run(l.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := Simulate(io.Discard, code, SimOptions{lookup: l.fn}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package sim8086
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A snapshot is the state of a Machine, written in little endian as
+//
+//	magic       [8]byte "8086SNAP"
+//	version     uint16
+//	cpu         uint16
+//	loadSegment uint16
+//	flags       uint16  (snapHalted)
+//	end         int32   physical address of the end of the program, or -1
+//	clocks      uint64
+//	executed    uint64
+//	registers   [RegCount]uint16
+//	memory      [1 << 20]byte
+//
+// The options that only affect how a run is traced or stopped, such as the
+// watchpoints, are not part of a snapshot, and neither are the interrupt
+// handlers and the undo journal.
+const (
+	snapMagic   = "8086SNAP"
+	snapVersion = 1
+)
+
+const snapHalted = 1
+
+var (
+	ErrBadSnapshot     = errors.New("not a snapshot")
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+)
+
+type snapHeader struct {
+	Magic       [8]byte
+	Version     uint16
+	CPU         uint16
+	LoadSegment uint16
+	Flags       uint16
+	End         int32
+	Clocks      uint64
+	Executed    uint64
+	Regs        Registers
+}
+
+// SaveState writes a snapshot of the machine to w, from which LoadState can
+// resume the simulation.
+func (m *Machine) SaveState(w io.Writer) error {
+	h := snapHeader{
+		Version:     snapVersion,
+		CPU:         uint16(m.opts.CPU),
+		LoadSegment: m.opts.LoadSegment,
+		End:         int32(m.end),
+		Clocks:      uint64(m.Clocks),
+		Executed:    uint64(m.Executed),
+		Regs:        m.Regs,
+	}
+	copy(h.Magic[:], snapMagic)
+	if m.Halted {
+		h.Flags |= snapHalted
+	}
+	if err := binary.Write(w, binary.LittleEndian, h); err != nil {
+		return err
+	}
+	_, err := w.Write(m.Mem[:])
+	return err
+}
+
+// LoadState returns the machine saved in a snapshot by SaveState. The CPU and
+// load segment are those of the saved machine, the other options are taken
+// from opts.
+func LoadState(r io.Reader, opts SimOptions) (*Machine, error) {
+	var h snapHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	if string(h.Magic[:]) != snapMagic {
+		return nil, fmt.Errorf("%w: magic %q", ErrBadSnapshot, h.Magic)
+	}
+	if h.Version != snapVersion {
+		return nil, fmt.Errorf("%w %d", ErrSnapshotVersion, h.Version)
+	}
+	if int(h.CPU) >= len(cpuStrs) {
+		return nil, fmt.Errorf("%w: cpu %d", ErrBadSnapshot, h.CPU)
+	}
+	m := &Machine{
+		Regs:     h.Regs,
+		Mem:      new(Memory),
+		Clocks:   int(h.Clocks),
+		Halted:   h.Flags&snapHalted != 0,
+		Executed: int(h.Executed),
+		opts:     opts,
+		end:      int(h.End),
+	}
+	if _, err := io.ReadFull(r, m.Mem[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	m.opts.CPU = CPU(h.CPU)
+	m.opts.LoadSegment = h.LoadSegment
+	return m, nil
+}
+
+// SaveStateFile writes a snapshot of the machine to file.
+func (m *Machine) SaveStateFile(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := m.SaveState(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadStateFile returns the machine saved in file by SaveStateFile.
+func LoadStateFile(file string, opts SimOptions) (*Machine, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadState(bufio.NewReader(f), opts)
+}
@@ -0,0 +1,16 @@
+bits 16
+org 0x100
+
+mov ah, 9
+mov dx, message
+int 0x21
+mov ah, 2
+mov dl, '!'
+int 0x21
+mov ax, 0x0e0a ; Teletype output of a newline
+int 0x10
+mov ax, 0x4c00
+int 0x21
+
+message:
+db "Hello, world$"
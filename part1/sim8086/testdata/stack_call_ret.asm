@@ -0,0 +1,28 @@
+bits 16
+
+mov sp, 256
+mov ax, 1
+call add_two
+call add_two
+mov bx, add_three
+call bx
+mov word [1000], add_three
+call [1000]
+push ax
+call pop_arg
+jmp done
+
+add_two:
+add ax, 2
+ret
+
+add_three:
+add ax, 3
+ret
+
+pop_arg:
+mov bp, sp
+mov cx, [bp+2]
+ret 2
+
+done:
@@ -0,0 +1,18 @@
+bits 16
+
+; The program is loaded at cs=0, so code at offset x can also be reached as
+; 1:x-16.
+mov sp, 256
+mov ax, 5
+call 1:far_proc-16
+mov word [1000], far_proc-16
+mov word [1002], 1
+call far [1000]
+jmp 1:done-16
+
+far_proc:
+shl ax, 1
+mov dx, cs
+retf
+
+done:
@@ -0,0 +1,28 @@
+bits 16
+
+; The interrupt vector table overlaps the start of the program, so the
+; vectors are only written once the code there has been executed.
+mov sp, 256
+mov word [128], handler ; int 0x20
+mov word [130], 0
+mov word [12], handler ; int3
+mov word [14], 0
+mov word [16], handler ; into
+mov word [18], 0
+sti
+mov ax, 1
+int 0x20
+int3
+into
+mov bx, 32767
+add bx, 1
+into
+jmp done
+
+handler:
+add ax, ax
+pushf
+pop cx
+iret
+
+done:
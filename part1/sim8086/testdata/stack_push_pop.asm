@@ -0,0 +1,27 @@
+bits 16
+
+mov sp, 256
+mov ax, 4660
+mov bx, 22136
+push ax
+push bx
+pop cx
+pop dx
+
+mov si, 12288
+push si
+pop es
+
+mov word [1000], 43981
+push word [1000]
+pop word [1002]
+mov di, [1002]
+
+push sp
+pop ax
+
+stc
+pushf
+pop bp
+push bx
+popf
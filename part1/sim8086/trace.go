@@ -0,0 +1,166 @@
+package sim8086
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// TraceRecord is a step of the trace in the form that RunJSON writes, one
+// JSON object per line. Registers, flags and memory only appear when the
+// instruction changed them.
+type TraceRecord struct {
+	CS          uint16 `json:"cs"`
+	IP          uint16 `json:"ip"`
+	Bytes       string `json:"bytes"` // Machine code in hex
+	Instruction string `json:"instruction"`
+	Clocks      int    `json:"clocks"`
+	// Old and new value of the registers that changed, not including the
+	// flags.
+	Regs   map[string][2]uint16 `json:"regs,omitempty"`
+	Flags  *FlagsChange         `json:"flags,omitempty"`
+	Writes []MemoryWrite        `json:"writes,omitempty"`
+}
+
+// The flags that were set before and after an instruction, as by
+// FlagsString.
+type FlagsChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+type MemoryWrite struct {
+	Addr int    `json:"addr"` // Physical address
+	Old  uint16 `json:"old"`
+	New  uint16 `json:"new"`
+	Word bool   `json:"word"`
+}
+
+// Record returns the step as a record of the JSON trace.
+func (s Step) Record() TraceRecord {
+	r := TraceRecord{
+		CS:          s.Prev[RegCs],
+		IP:          s.Prev[RegIp],
+		Bytes:       hex.EncodeToString(Encode(s.Instruction)),
+		Instruction: s.Instruction.String(),
+		Clocks:      s.Clocks.Total(),
+	}
+	for reg := RegAx; reg < RegFlags; reg++ {
+		if t0, t1 := s.Prev[reg], s.Regs[reg]; t0 != t1 {
+			if r.Regs == nil {
+				r.Regs = make(map[string][2]uint16)
+			}
+			r.Regs[OperandReg{reg, WidthFull}.String()] = [2]uint16{t0, t1}
+		}
+	}
+	if f0, f1 := s.Prev[RegFlags], s.Regs[RegFlags]; f0 != f1 {
+		r.Flags = &FlagsChange{FlagsString(f0), FlagsString(f1)}
+	}
+	for _, a := range s.accesses {
+		if a.write {
+			r.Writes = append(r.Writes, MemoryWrite{a.addr(), a.old, a.new, a.word})
+		}
+	}
+	return r
+}
+
+// RunJSON executes instructions like Run, but writes the trace to w as JSON,
+// one TraceRecord per line, without the summary at the end.
+func (m *Machine) RunJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for !m.atEnd() {
+		step, err := m.Step()
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(step.Record()); err != nil {
+			return err
+		}
+		if m.Halted {
+			break
+		}
+	}
+	return nil
+}
+
+// Divergence is the first step at which two JSON traces differ.
+type Divergence struct {
+	Step int          // Index of the step, counting from 0
+	A, B *TraceRecord // Nil if the trace ended before the step
+	// JSON names of the fields that differ, empty if one of the traces
+	// ended.
+	Fields []string
+}
+
+func (d *Divergence) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "traces diverge at step %d", d.Step)
+	if len(d.Fields) > 0 {
+		fmt.Fprintf(&sb, " in %s", strings.Join(d.Fields, ", "))
+	}
+	for _, t := range []struct {
+		name string
+		r    *TraceRecord
+	}{{"a", d.A}, {"b", d.B}} {
+		if t.r == nil {
+			fmt.Fprintf(&sb, "\n%s: end of trace", t.name)
+			continue
+		}
+		line, _ := json.Marshal(t.r)
+		fmt.Fprintf(&sb, "\n%s: %s", t.name, line)
+	}
+	return sb.String()
+}
+
+// FirstDivergence reads two JSON traces, as written by RunJSON, and returns
+// the first step at which they differ, or nil if they are the same.
+func FirstDivergence(a, b io.Reader) (*Divergence, error) {
+	da, db := json.NewDecoder(a), json.NewDecoder(b)
+	// Returns the next record of the trace, or nil at its end.
+	next := func(dec *json.Decoder) (*TraceRecord, error) {
+		r := new(TraceRecord)
+		if err := dec.Decode(r); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return r, nil
+	}
+	for step := 0; ; step++ {
+		ra, err := next(da)
+		if err != nil {
+			return nil, fmt.Errorf("trace a, step %d: %w", step, err)
+		}
+		rb, err := next(db)
+		if err != nil {
+			return nil, fmt.Errorf("trace b, step %d: %w", step, err)
+		}
+		switch {
+		case ra == nil && rb == nil:
+			return nil, nil
+		case ra == nil || rb == nil:
+			return &Divergence{Step: step, A: ra, B: rb}, nil
+		}
+		if fields := differingFields(ra, rb); len(fields) > 0 {
+			return &Divergence{step, ra, rb, fields}, nil
+		}
+	}
+}
+
+// Returns the JSON names of the fields that differ between the records.
+func differingFields(a, b *TraceRecord) []string {
+	var fields []string
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			name, _, _ := strings.Cut(va.Type().Field(i).Tag.Get("json"), ",")
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
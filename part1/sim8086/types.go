@@ -0,0 +1,1058 @@
+// Package sim8086 decodes, disassembles, assembles and simulates 8086 machine
+// code.
+package sim8086
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Op uint32
+
+const (
+	OpMov Op = iota
+	OpAdd
+	OpSub
+	OpCmp
+	OpJe
+	OpJl
+	OpJle
+	OpJb
+	OpJbe
+	OpJp
+	OpJo
+	OpJs
+	OpJne
+	OpJnl
+	OpJnle
+	OpJnb
+	OpJnbe
+	OpJnp
+	OpJno
+	OpJns
+	OpLoop
+	OpLoopz
+	OpLoopnz
+	OpJcxz
+	OpPush
+	OpPop
+	OpXchg
+	OpIn
+	OpOut
+	OpXlat
+	OpLea
+	OpLds
+	OpLes
+	OpLahf
+	OpSahf
+	OpPushf
+	OpPopf
+	OpAdc
+	OpInc
+	OpAaa
+	OpDaa
+	OpSbb
+	OpDec
+	OpNeg
+	OpAas
+	OpDas
+	OpMul
+	OpImul
+	OpAam
+	OpDiv
+	OpIdiv
+	OpAad
+	OpCbw
+	OpCwd
+	OpNot
+	OpShl
+	OpShr
+	OpSar
+	OpRol
+	OpRor
+	OpRcl
+	OpRcr
+	OpAnd
+	OpTest
+	OpOr
+	OpXor
+	OpMovsb
+	OpMovsw
+	OpCmpsb
+	OpCmpsw
+	OpScasb
+	OpScasw
+	OpLodsb
+	OpLodsw
+	OpStosb
+	OpStosw
+	OpCall
+	OpJmp
+	OpRet
+	OpRetf
+	OpInt
+	OpInt3
+	OpInto
+	OpIret
+	OpClc
+	OpCmc
+	OpStc
+	OpCld
+	OpStd
+	OpCli
+	OpSti
+	OpHlt
+	OpWait
+)
+
+var opStrs = [...]string{
+	"mov",
+	"add",
+	"sub",
+	"cmp",
+	"je",
+	"jl",
+	"jle",
+	"jb",
+	"jbe",
+	"jp",
+	"jo",
+	"js",
+	"jne",
+	"jnl",
+	"jnle",
+	"jnb",
+	"jnbe",
+	"jnp",
+	"jno",
+	"jns",
+	"loop",
+	"loopz",
+	"loopnz",
+	"jcxz",
+	"push",
+	"pop",
+	"xchg",
+	"in",
+	"out",
+	"xlat",
+	"lea",
+	"lds",
+	"les",
+	"lahf",
+	"sahf",
+	"pushf",
+	"popf",
+	"adc",
+	"inc",
+	"aaa",
+	"daa",
+	"sbb",
+	"dec",
+	"neg",
+	"aas",
+	"das",
+	"mul",
+	"imul",
+	"aam",
+	"div",
+	"idiv",
+	"aad",
+	"cbw",
+	"cwd",
+	"not",
+	"shl",
+	"shr",
+	"sar",
+	"rol",
+	"ror",
+	"rcl",
+	"rcr",
+	"and",
+	"test",
+	"or",
+	"xor",
+	"movsb",
+	"movsw",
+	"cmpsb",
+	"cmpsw",
+	"scasb",
+	"scasw",
+	"lodsb",
+	"lodsw",
+	"stosb",
+	"stosw",
+	"call",
+	"jmp",
+	"ret",
+	"retf",
+	"int",
+	"int3",
+	"into",
+	"iret",
+	"clc",
+	"cmc",
+	"stc",
+	"cld",
+	"std",
+	"cli",
+	"sti",
+	"hlt",
+	"wait",
+}
+
+func (o Op) String() string {
+	return opStrs[o]
+}
+
+type OpKind uint32
+
+const (
+	KindRmToFromRm OpKind = iota
+	KindMemToFromAcc
+	KindImmToRm
+	KindImmToReg
+	KindImmToAcc
+	KindRmToSeg
+	KindSegToRm
+	KindCondJmp
+	KindNone        // No operands
+	KindRm          // Single register/memory operand
+	KindReg         // Single word register encoded in the opcode
+	KindAccReg      // Accumulator and word register encoded in the opcode
+	KindSeg         // Segment register encoded in the opcode
+	KindShift       // Register/memory shifted by 1 or cl
+	KindLoadAddr    // lea, lds, les
+	KindInOut       // in/out with fixed or variable (dx) port
+	KindNearJmp     // 16-bit relative call/jmp
+	KindFarJmp      // Direct intersegment call/jmp
+	KindImm8        // Single byte immediate
+	KindImm16       // Single word immediate
+	KindAsciiAdjust // aam, aad
+	KindUnknown
+)
+
+type OpDescr struct {
+	kind OpKind
+	op   Op
+}
+
+// The eight arithmetic and logic operations, in the order given by the
+// opcode bits of 00ooo0dw/00ooo10w and by the REG field of 100000sw.
+var aluOps = [...]Op{OpAdd, OpOr, OpAdc, OpSbb, OpAnd, OpSub, OpXor, OpCmp}
+
+// Shifts and rotates in the order given by the REG field of 110100vw. REG
+// 110 is not used by the 8086 and is checked for separately.
+var shiftOps = [...]Op{OpRol, OpRor, OpRcl, OpRcr, OpShl, OpShr, OpShl, OpSar}
+
+func operation(b1, b2 byte) OpDescr {
+	REG := (b2 >> 3) & 0b111
+	switch b1 {
+	case 0b10001110:
+		return OpDescr{KindRmToSeg, OpMov}
+	case 0b10001100:
+		return OpDescr{KindSegToRm, OpMov}
+	case 0b11000110, 0b11000111:
+		return OpDescr{KindImmToRm, OpMov}
+	case 0b01110100:
+		return OpDescr{KindCondJmp, OpJe}
+	case 0b01111100:
+		return OpDescr{KindCondJmp, OpJl}
+	case 0b01111110:
+		return OpDescr{KindCondJmp, OpJle}
+	case 0b01110010:
+		return OpDescr{KindCondJmp, OpJb}
+	case 0b01110110:
+		return OpDescr{KindCondJmp, OpJbe}
+	case 0b01111010:
+		return OpDescr{KindCondJmp, OpJp}
+	case 0b01110000:
+		return OpDescr{KindCondJmp, OpJo}
+	case 0b01111000:
+		return OpDescr{KindCondJmp, OpJs}
+	case 0b01110101:
+		return OpDescr{KindCondJmp, OpJne}
+	case 0b01111101:
+		return OpDescr{KindCondJmp, OpJnl}
+	case 0b01111111:
+		return OpDescr{KindCondJmp, OpJnle}
+	case 0b01110011:
+		return OpDescr{KindCondJmp, OpJnb}
+	case 0b01110111:
+		return OpDescr{KindCondJmp, OpJnbe}
+	case 0b01111011:
+		return OpDescr{KindCondJmp, OpJnp}
+	case 0b01110001:
+		return OpDescr{KindCondJmp, OpJno}
+	case 0b01111001:
+		return OpDescr{KindCondJmp, OpJns}
+	case 0b11100010:
+		return OpDescr{KindCondJmp, OpLoop}
+	case 0b11100001:
+		return OpDescr{KindCondJmp, OpLoopz}
+	case 0b11100000:
+		return OpDescr{KindCondJmp, OpLoopnz}
+	case 0b11100011:
+		return OpDescr{KindCondJmp, OpJcxz}
+	case 0b11101011:
+		// Short jump uses the same 8-bit relative encoding as the conditional
+		// jumps.
+		return OpDescr{KindCondJmp, OpJmp}
+	case 0b11101000:
+		return OpDescr{KindNearJmp, OpCall}
+	case 0b11101001:
+		return OpDescr{KindNearJmp, OpJmp}
+	case 0b10011010:
+		return OpDescr{KindFarJmp, OpCall}
+	case 0b11101010:
+		return OpDescr{KindFarJmp, OpJmp}
+	case 0b11000010:
+		return OpDescr{KindImm16, OpRet}
+	case 0b11001010:
+		return OpDescr{KindImm16, OpRetf}
+	case 0b11000011:
+		return OpDescr{KindNone, OpRet}
+	case 0b11001011:
+		return OpDescr{KindNone, OpRetf}
+	case 0b11001101:
+		return OpDescr{KindImm8, OpInt}
+	case 0b11001100:
+		return OpDescr{KindNone, OpInt3}
+	case 0b11001110:
+		return OpDescr{KindNone, OpInto}
+	case 0b11001111:
+		return OpDescr{KindNone, OpIret}
+	case 0b10000100, 0b10000101:
+		return OpDescr{KindRmToFromRm, OpTest}
+	case 0b10000110, 0b10000111:
+		return OpDescr{KindRmToFromRm, OpXchg}
+	case 0b10101000, 0b10101001:
+		return OpDescr{KindImmToAcc, OpTest}
+	case 0b10001111:
+		return OpDescr{KindRm, OpPop}
+	case 0b10001101:
+		return OpDescr{KindLoadAddr, OpLea}
+	case 0b11000101:
+		return OpDescr{KindLoadAddr, OpLds}
+	case 0b11000100:
+		return OpDescr{KindLoadAddr, OpLes}
+	case 0b11100100, 0b11100101, 0b11101100, 0b11101101:
+		return OpDescr{KindInOut, OpIn}
+	case 0b11100110, 0b11100111, 0b11101110, 0b11101111:
+		return OpDescr{KindInOut, OpOut}
+	case 0b11010100:
+		return OpDescr{KindAsciiAdjust, OpAam}
+	case 0b11010101:
+		return OpDescr{KindAsciiAdjust, OpAad}
+	case 0b11010111:
+		return OpDescr{KindNone, OpXlat}
+	case 0b10011111:
+		return OpDescr{KindNone, OpLahf}
+	case 0b10011110:
+		return OpDescr{KindNone, OpSahf}
+	case 0b10011100:
+		return OpDescr{KindNone, OpPushf}
+	case 0b10011101:
+		return OpDescr{KindNone, OpPopf}
+	case 0b00110111:
+		return OpDescr{KindNone, OpAaa}
+	case 0b00100111:
+		return OpDescr{KindNone, OpDaa}
+	case 0b00111111:
+		return OpDescr{KindNone, OpAas}
+	case 0b00101111:
+		return OpDescr{KindNone, OpDas}
+	case 0b10011000:
+		return OpDescr{KindNone, OpCbw}
+	case 0b10011001:
+		return OpDescr{KindNone, OpCwd}
+	case 0b10100100:
+		return OpDescr{KindNone, OpMovsb}
+	case 0b10100101:
+		return OpDescr{KindNone, OpMovsw}
+	case 0b10100110:
+		return OpDescr{KindNone, OpCmpsb}
+	case 0b10100111:
+		return OpDescr{KindNone, OpCmpsw}
+	case 0b10101110:
+		return OpDescr{KindNone, OpScasb}
+	case 0b10101111:
+		return OpDescr{KindNone, OpScasw}
+	case 0b10101100:
+		return OpDescr{KindNone, OpLodsb}
+	case 0b10101101:
+		return OpDescr{KindNone, OpLodsw}
+	case 0b10101010:
+		return OpDescr{KindNone, OpStosb}
+	case 0b10101011:
+		return OpDescr{KindNone, OpStosw}
+	case 0b11111000:
+		return OpDescr{KindNone, OpClc}
+	case 0b11110101:
+		return OpDescr{KindNone, OpCmc}
+	case 0b11111001:
+		return OpDescr{KindNone, OpStc}
+	case 0b11111100:
+		return OpDescr{KindNone, OpCld}
+	case 0b11111101:
+		return OpDescr{KindNone, OpStd}
+	case 0b11111010:
+		return OpDescr{KindNone, OpCli}
+	case 0b11111011:
+		return OpDescr{KindNone, OpSti}
+	case 0b11110100:
+		return OpDescr{KindNone, OpHlt}
+	case 0b10011011:
+		return OpDescr{KindNone, OpWait}
+	case 0b11110110, 0b11110111:
+		switch REG {
+		case 0b000:
+			return OpDescr{KindImmToRm, OpTest}
+		case 0b010:
+			return OpDescr{KindRm, OpNot}
+		case 0b011:
+			return OpDescr{KindRm, OpNeg}
+		case 0b100:
+			return OpDescr{KindRm, OpMul}
+		case 0b101:
+			return OpDescr{KindRm, OpImul}
+		case 0b110:
+			return OpDescr{KindRm, OpDiv}
+		case 0b111:
+			return OpDescr{KindRm, OpIdiv}
+		}
+	case 0b11111110, 0b11111111:
+		switch REG {
+		case 0b000:
+			return OpDescr{KindRm, OpInc}
+		case 0b001:
+			return OpDescr{KindRm, OpDec}
+		}
+		if b1 == 0b11111110 {
+			break
+		}
+		switch REG {
+		case 0b010, 0b011:
+			return OpDescr{KindRm, OpCall}
+		case 0b100, 0b101:
+			return OpDescr{KindRm, OpJmp}
+		case 0b110:
+			return OpDescr{KindRm, OpPush}
+		}
+	}
+	// Segment register push and pop: 000sr110 and 000sr111.
+	if b1 < 0b00100000 && b1&0b110 == 0b110 {
+		return OpDescr{KindSeg, [...]Op{OpPush, OpPop}[b1&1]}
+	}
+	// Arithmetic and logic: 00ooo0dw and 00ooo10w.
+	if b1 < 0b01000000 && b1&0b110 != 0b110 {
+		if b1&0b100 == 0 {
+			return OpDescr{KindRmToFromRm, aluOps[b1>>3]}
+		}
+		return OpDescr{KindImmToAcc, aluOps[b1>>3]}
+	}
+	switch b1 >> 2 {
+	case 0b100010:
+		return OpDescr{KindRmToFromRm, OpMov}
+	case 0b101000:
+		return OpDescr{KindMemToFromAcc, OpMov}
+	case 0b100000:
+		return OpDescr{KindImmToRm, aluOps[REG]}
+	case 0b110100:
+		if REG != 0b110 {
+			return OpDescr{KindShift, shiftOps[REG]}
+		}
+	}
+	switch b1 >> 3 {
+	case 0b01000:
+		return OpDescr{KindReg, OpInc}
+	case 0b01001:
+		return OpDescr{KindReg, OpDec}
+	case 0b01010:
+		return OpDescr{KindReg, OpPush}
+	case 0b01011:
+		return OpDescr{KindReg, OpPop}
+	case 0b10010:
+		return OpDescr{KindAccReg, OpXchg}
+	}
+	if b1>>4 == 0b1011 {
+		return OpDescr{KindImmToReg, OpMov}
+	}
+	return OpDescr{kind: KindUnknown}
+}
+
+type Memory [1 << 20]byte
+
+// Physical returns the 20-bit physical address of segment:offset. Addresses
+// past the end of memory wrap around to the start.
+func Physical(seg, offset uint16) int {
+	return (int(seg)<<4 + int(offset)) & (len(Memory{}) - 1)
+}
+
+// Read returns the byte or word at segment:offset. The high byte of a word at
+// offset 0xffff is read from the start of the segment.
+func (m *Memory) Read(seg, offset uint16, word bool) uint16 {
+	value := uint16(m[Physical(seg, offset)])
+	if word {
+		value |= uint16(m[Physical(seg, offset+1)]) << 8
+	}
+	return value
+}
+
+// Write writes the byte or word value to segment:offset.
+func (m *Memory) Write(seg, offset uint16, value uint16, word bool) {
+	m[Physical(seg, offset)] = byte(value)
+	if word {
+		m[Physical(seg, offset+1)] = byte(value >> 8)
+	}
+}
+
+type Register uint32
+
+const (
+	RegAx    Register = iota // Accumulator
+	RegBx                    // Base
+	RegCx                    // Count
+	RegDx                    // Data
+	RegSp                    // Stack pointer
+	RegBp                    // Base pointer
+	RegSi                    // Source index
+	RegDi                    // Destination index
+	RegEs                    // Extra segment
+	RegCs                    // Code segment
+	RegSs                    // Stack segment
+	RegDs                    // Data segment
+	RegIp                    // Instruction pointer
+	RegFlags                 // Flags
+	RegCount
+)
+
+// Type alias for flags for documentation's sake.
+type Flags = uint16
+
+// Flags are described on page 22 of the manual.
+const (
+	FlagC Flags = 1       // Carry
+	FlagP Flags = 1 << 2  // Parity
+	FlagA Flags = 1 << 4  // Auxiliary Carry
+	FlagZ Flags = 1 << 6  // Zero
+	FlagS Flags = 1 << 7  // Sign
+	FlagT Flags = 1 << 8  // Trap
+	FlagI Flags = 1 << 9  // Interrupt enable
+	FlagD Flags = 1 << 10 // Direction
+	FlagO Flags = 1 << 11 // Overflow
+)
+
+// All the flags that are defined. The remaining bits always read as set
+// when the flags are pushed onto the stack.
+const (
+	allFlags            = FlagC | FlagP | FlagA | FlagZ | FlagS | FlagT | FlagI | FlagD | FlagO
+	reservedFlags Flags = 0xf002
+	// The flags in the low byte, as transferred by lahf and sahf.
+	lahfFlags = FlagS | FlagZ | FlagA | FlagP | FlagC
+)
+
+func FlagString(f Flags) string {
+	switch f {
+	case FlagC:
+		return "C"
+	case FlagP:
+		return "P"
+	case FlagA:
+		return "A"
+	case FlagZ:
+		return "Z"
+	case FlagS:
+		return "S"
+	case FlagT:
+		return "T"
+	case FlagI:
+		return "I"
+	case FlagD:
+		return "D"
+	case FlagO:
+		return "O"
+	}
+	panic("FlagString")
+}
+
+var regFlags = [...]Flags{
+	FlagC, FlagP, FlagA, FlagZ, FlagS, FlagT, FlagI, FlagD, FlagO,
+}
+
+type RegisterWidth uint32
+
+const (
+	WidthFull RegisterWidth = iota
+	WidthLo
+	WidthHi
+)
+
+type Registers [RegCount]uint16
+
+func (rr *Registers) IsSet(flag Flags) bool {
+	return rr[RegFlags]&flag > 0
+}
+
+func (rr *Registers) JumpIf(cond bool, dst Operand) {
+	if dst.kind != operandImm {
+		panic(dst)
+	}
+	if cond {
+		rr[RegIp] += dst.imm
+	}
+}
+
+func (rr *Registers) String() string {
+	var sb strings.Builder
+	for i := RegAx; i < RegFlags; i++ {
+		fmt.Fprintf(&sb, "%5s: 0x%04x (%d)\n", OperandReg{i, WidthFull}, rr[i], rr[i])
+	}
+	fmt.Fprintf(&sb, "flags: ")
+	for _, flag := range regFlags {
+		if rr.IsSet(flag) {
+			fmt.Fprintf(&sb, "%s", FlagString(flag))
+		}
+	}
+	fmt.Fprintln(&sb)
+	return sb.String()
+}
+
+// Summary only prints out the non-zero registers.
+func (rr *Registers) Summary() string {
+	var sb strings.Builder
+	sb.WriteString("Final registers:\n")
+	for i := RegAx; i < RegFlags; i++ {
+		if rr[i] != 0 {
+			fmt.Fprintf(&sb, "%8s: 0x%04x (%d)\n", OperandReg{i, WidthFull}, rr[i], rr[i])
+		}
+	}
+	if rr[RegFlags] != 0 {
+		fmt.Fprintf(&sb, "%8s: ", "flags")
+		for _, flag := range regFlags {
+			if rr.IsSet(flag) {
+				fmt.Fprintf(&sb, "%s", FlagString(flag))
+			}
+		}
+		fmt.Fprintln(&sb)
+	}
+	return sb.String()
+}
+
+func FlagsString(flags Flags) string {
+	var sb strings.Builder
+	for _, flag := range regFlags {
+		if flags&flag != 0 {
+			fmt.Fprintf(&sb, "%s", FlagString(flag))
+		}
+	}
+	return sb.String()
+}
+
+// Operand is a register, an immediate, a memory address or a far pointer,
+// with an optional size. It stores its value without an interface, so that
+// decoding does not allocate. Op returns the value as an OperandType.
+type Operand struct {
+	Size SizeMark
+	kind operandKind
+	reg  OperandReg
+	imm  uint16 // Value of OperandImm and OperandImmU
+	disp OperandDisplacement
+	far  OperandFarPtr
+}
+
+type operandKind uint8
+
+const (
+	operandNone operandKind = iota
+	operandReg
+	operandImm
+	operandImmU
+	operandDisp
+	operandFarPtr
+)
+
+// NewOperand returns an operand of the given size with the value v.
+func NewOperand(size SizeMark, v OperandType) Operand {
+	o := Operand{Size: size}
+	switch v := v.(type) {
+	case OperandReg:
+		o.kind, o.reg = operandReg, v
+	case OperandImm:
+		o.kind, o.imm = operandImm, uint16(v)
+	case OperandImmU:
+		o.kind, o.imm = operandImmU, uint16(v)
+	case OperandDisplacement:
+		o.kind, o.disp = operandDisp, v
+	case OperandFarPtr:
+		o.kind, o.far = operandFarPtr, v
+	}
+	return o
+}
+
+// Returns an operand without a size.
+func unsized(v OperandType) Operand {
+	return NewOperand(SizeNone, v)
+}
+
+// Op returns the value of the operand, or nil for the zero Operand.
+func (o Operand) Op() OperandType {
+	switch o.kind {
+	case operandReg:
+		return o.reg
+	case operandImm:
+		return OperandImm(o.imm)
+	case operandImmU:
+		return OperandImmU(o.imm)
+	case operandDisp:
+		return o.disp
+	case operandFarPtr:
+		return o.far
+	}
+	return nil
+}
+
+type (
+	OperandType interface{ operandType() }
+	OperandReg  struct {
+		Name  Register
+		Width RegisterWidth
+	}
+	OperandImm          int16
+	OperandImmU         uint16
+	OperandDisplacement struct {
+		Kind DisplacementKind
+		Imm  OperandImm
+		Seg  SegOverride
+	}
+	OperandFarPtr struct {
+		Seg, Offset uint16
+	}
+)
+
+func (_ OperandReg) operandType()          {}
+func (_ OperandImm) operandType()          {}
+func (_ OperandImmU) operandType()         {}
+func (_ OperandDisplacement) operandType() {}
+func (_ OperandFarPtr) operandType()       {}
+
+type SizeMark uint32
+
+const (
+	SizeNone SizeMark = iota
+	SizeByte
+	SizeWord
+	SizeNear
+	SizeFar
+)
+
+var sizeMarkStrs = [...]string{
+	"", "byte", "word", "near", "far",
+}
+
+func (o Operand) String() string {
+	var sb strings.Builder
+	if o.Size != SizeNone {
+		fmt.Fprintf(&sb, "%s ", o.Size)
+	}
+	fmt.Fprintf(&sb, "%v", o.Op())
+	return sb.String()
+}
+
+func (s SizeMark) String() string {
+	return sizeMarkStrs[s]
+}
+
+func SizeFrom(w byte) SizeMark {
+	return [...]SizeMark{SizeByte, SizeWord}[w]
+}
+
+var regStrsFull = [...][3]string{
+	{"ax", "al", "ah"},
+	{"bx", "bl", "bh"},
+	{"cx", "cl", "ch"},
+	{"dx", "dl", "dh"},
+	{"sp", "", ""},
+	{"bp", "", ""},
+	{"si", "", ""},
+	{"di", "", ""},
+	{"es", "", ""},
+	{"cs", "", ""},
+	{"ss", "", ""},
+	{"ds", "", ""},
+	{"ip", "", ""},
+}
+
+func (r OperandReg) String() string {
+	return regStrsFull[r.Name][r.Width]
+}
+
+// Note the unexpected order of the first four registers: AX, CX, DX, BX.
+var regVal = [...]OperandReg{
+	{RegAx, WidthLo}, {RegCx, WidthLo}, {RegDx, WidthLo}, {RegBx, WidthLo},
+	{RegAx, WidthHi}, {RegCx, WidthHi}, {RegDx, WidthHi}, {RegBx, WidthHi},
+	{RegAx, WidthFull}, {RegCx, WidthFull}, {RegDx, WidthFull}, {RegBx, WidthFull},
+	{RegSp, WidthFull}, {RegBp, WidthFull}, {RegSi, WidthFull}, {RegDi, WidthFull},
+}
+
+func register(reg, w byte) OperandReg {
+	return regVal[w<<3|reg]
+}
+
+var segmentRegs = [...]Register{RegEs, RegCs, RegSs, RegDs}
+
+// Segment register code is listed in Table 4-11 in the manual.
+func Segment(SR byte) OperandReg {
+	return OperandReg{segmentRegs[SR], WidthFull}
+}
+
+type DisplacementKind uint32
+
+const (
+	DispBxSi DisplacementKind = iota
+	DispBxDi
+	DispBpSi
+	DispBpDi
+	DispSi
+	DispDi
+	DispBp
+	DispBx
+	DispEA
+)
+
+var dispKindStrs = [...]string{
+	"bx+si", "bx+di", "bp+si", "bp+di", "si", "di", "bp", "bx",
+}
+
+func (d OperandDisplacement) String() string {
+	var seg string
+	if d.Seg != SegNone {
+		seg = d.Seg.String() + ":"
+	}
+	if d.Kind == DispEA {
+		return fmt.Sprintf("[%s%d]", seg, uint16(d.Imm))
+	}
+	return fmt.Sprintf("[%s%s%+d]", seg, dispKindStrs[d.Kind], d.Imm)
+}
+
+// Segment returns the segment register the address is relative to: the
+// explicit override if there is one, otherwise ss for bp based addressing
+// and ds for everything else.
+func (d OperandDisplacement) Segment() Register {
+	if d.Seg != SegNone {
+		return d.Seg.Register()
+	}
+	switch d.Kind {
+	case DispBpSi, DispBpDi, DispBp:
+		return RegSs
+	}
+	return RegDs
+}
+
+type SegOverride uint32
+
+// Segment overrides are in the same order as the segment register codes, so
+// that the override for code SR is SegOverride(SR+1).
+const (
+	SegNone SegOverride = iota
+	SegEs
+	SegCs
+	SegSs
+	SegDs
+)
+
+func (s SegOverride) String() string {
+	return regStrsFull[s.Register()][WidthFull]
+}
+
+func (s SegOverride) Register() Register {
+	return segmentRegs[s-1]
+}
+
+type RepPrefix uint32
+
+const (
+	RepNone RepPrefix = iota
+	Rep
+	Repne
+)
+
+var repPrefixStrs = [...]string{
+	"", "rep", "repne",
+}
+
+func (r RepPrefix) String() string {
+	return repPrefixStrs[r]
+}
+
+// Prefix holds the prefixes an instruction was encoded with.
+type Prefix struct {
+	Lock bool
+	Rep  RepPrefix
+	Seg  SegOverride
+}
+
+// Add records the prefix byte b and reports whether b is a prefix at all.
+func (p *Prefix) Add(b byte) bool {
+	switch {
+	case b == 0b11110000:
+		p.Lock = true
+	case b == 0b11110011:
+		p.Rep = Rep
+	case b == 0b11110010:
+		p.Rep = Repne
+	case b&0b11100111 == 0b00100110:
+		// Segment override is encoded as 001sr110.
+		p.Seg = SegOverride((b>>3)&0b11 + 1)
+	default:
+		return false
+	}
+	return true
+}
+
+func (p OperandFarPtr) String() string {
+	return fmt.Sprintf("%d:%d", p.Seg, p.Offset)
+}
+
+func OperandSigned(bb []byte) OperandImm {
+	var i int16
+	switch len(bb) {
+	case 1:
+		i = int16(int8(bb[0]))
+	case 2:
+		i = int16(uint16(bb[0]) | uint16(bb[1])<<8)
+	default:
+		panic(len(bb))
+	}
+	return OperandImm(i)
+}
+
+func OperandUnsigned(bb []byte) OperandImmU {
+	var u uint16
+	switch len(bb) {
+	case 1:
+		u = uint16(bb[0])
+	case 2:
+		u = uint16(bb[0]) | uint16(bb[1])<<8
+	default:
+		panic(len(bb))
+	}
+	return OperandImmU(u)
+}
+
+type Instruction struct {
+	Op     Op
+	Kind   OpKind
+	Size   int // Encoded length in bytes, including prefixes
+	Prefix Prefix
+	// The operands are stored in the instruction rather than in a slice, so
+	// that decoding does not allocate.
+	operands  [2]Operand
+	nOperands int
+	form      encodingForm // How it was encoded, if it was decoded
+}
+
+// NewInstruction returns an instruction with at most two operands.
+func NewInstruction(op Op, operands ...Operand) Instruction {
+	in := Instruction{Op: op}
+	in.SetOperands(operands...)
+	return in
+}
+
+// Operands returns the operands of the instruction. The slice refers to the
+// instruction, changing its elements changes the instruction.
+func (in *Instruction) Operands() []Operand {
+	return in.operands[:in.nOperands]
+}
+
+// SetOperands replaces the operands of the instruction.
+func (in *Instruction) SetOperands(operands ...Operand) {
+	if len(operands) > len(in.operands) {
+		panic(fmt.Sprintf("%d operands", len(operands)))
+	}
+	in.operands = [2]Operand{}
+	in.nOperands = copy(in.operands[:], operands)
+}
+
+// IsRelJump reports whether the instruction is a jump, loop or call with a
+// target relative to the end of the instruction.
+func (in Instruction) IsRelJump() bool {
+	if in.nOperands != 1 || in.operands[0].kind != operandImm {
+		return false
+	}
+	return OpJe <= in.Op && in.Op <= OpJcxz || in.Op == OpJmp || in.Op == OpCall
+}
+
+// Target returns the offset a relative jump at offset ip jumps to.
+func (in Instruction) Target(ip int) int {
+	return ip + in.Size + int(int16(in.operands[0].imm))
+}
+
+func (in Instruction) String() string {
+	return in.format("")
+}
+
+// WithLabel returns the disassembly with the target of a relative jump
+// printed as the given label.
+func (in Instruction) WithLabel(label string) string {
+	return in.format(label)
+}
+
+func (in Instruction) format(label string) string {
+	var sb strings.Builder
+	if in.Prefix.Lock {
+		fmt.Fprint(&sb, "lock ")
+	}
+	if in.Prefix.Rep != RepNone {
+		fmt.Fprintf(&sb, "%s ", in.Prefix.Rep)
+	}
+	// A segment override is printed as part of the memory operand, unless
+	// there is none to attach it to (e.g. string instructions and xlat).
+	if in.Prefix.Seg != SegNone && !in.hasMemOperand() {
+		fmt.Fprintf(&sb, "%s ", in.Prefix.Seg)
+	}
+	fmt.Fprintf(&sb, "%s", in.Op)
+	for j, o := range in.Operands() {
+		if j > 0 {
+			fmt.Fprint(&sb, ",")
+		}
+		fmt.Fprint(&sb, " ")
+		if in.IsRelJump() {
+			if o.Size != SizeNone {
+				fmt.Fprintf(&sb, "%s ", o.Size)
+			}
+			if label != "" {
+				fmt.Fprintf(&sb, "%s", label)
+			} else {
+				// Offset is relative to end of instruction and therefore needs the
+				// size of the instruction added.
+				fmt.Fprintf(&sb, "$%+d", int(int16(o.imm))+in.Size)
+			}
+		} else {
+			fmt.Fprintf(&sb, "%s", o)
+		}
+	}
+	return sb.String()
+}
+
+func (in Instruction) hasMemOperand() bool {
+	_, ok := in.memOperand()
+	return ok
+}
+
+func (in Instruction) memOperand() (OperandDisplacement, bool) {
+	for _, o := range in.Operands() {
+		if o.kind == operandDisp {
+			return o.disp, true
+		}
+	}
+	return OperandDisplacement{}, false
+}
+
+func boolToInt(b bool) uint16 {
+	var t uint16
+	if b {
+		t = 1
+	}
+	return t
+}
@@ -0,0 +1,119 @@
+package sim8086
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Watchpoint watches reads or writes of a range of physical addresses.
+type Watchpoint struct {
+	Start, End  int // End is exclusive
+	Read, Write bool
+	// Halt the simulation after the instruction that accessed the range,
+	// instead of only logging the access.
+	Halt bool
+}
+
+var ErrBadWatchpoint = errors.New("bad watchpoint")
+
+// ParseWatchpoint parses a watchpoint of the form mode:start[-end][:halt],
+// where mode is r, w or rw and end is exclusive. Without an end a single
+// byte is watched.
+func ParseWatchpoint(s string) (Watchpoint, error) {
+	var wp Watchpoint
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return wp, fmt.Errorf("%w %q: want mode:start[-end][:halt]", ErrBadWatchpoint, s)
+	}
+	switch parts[0] {
+	case "r":
+		wp.Read = true
+	case "w":
+		wp.Write = true
+	case "rw":
+		wp.Read, wp.Write = true, true
+	default:
+		return wp, fmt.Errorf("%w %q: mode must be r, w or rw", ErrBadWatchpoint, s)
+	}
+	start, end, found := strings.Cut(parts[1], "-")
+	v, err := strconv.ParseUint(start, 0, 20)
+	if err != nil {
+		return wp, fmt.Errorf("%w %q: %v", ErrBadWatchpoint, s, err)
+	}
+	wp.Start, wp.End = int(v), int(v)+1
+	if found {
+		v, err := strconv.ParseUint(end, 0, 21)
+		if err != nil || int(v) <= wp.Start || v > 1<<20 {
+			return wp, fmt.Errorf("%w %q: invalid end", ErrBadWatchpoint, s)
+		}
+		wp.End = int(v)
+	}
+	if len(parts) == 3 {
+		if parts[2] != "halt" {
+			return wp, fmt.Errorf("%w %q: unknown option %q", ErrBadWatchpoint, s, parts[2])
+		}
+		wp.Halt = true
+	}
+	return wp, nil
+}
+
+func (wp Watchpoint) String() string {
+	var mode string
+	if wp.Read {
+		mode += "r"
+	}
+	if wp.Write {
+		mode += "w"
+	}
+	s := fmt.Sprintf("%s:0x%05x-0x%05x", mode, wp.Start, wp.End)
+	if wp.Halt {
+		s += ":halt"
+	}
+	return s
+}
+
+// Reports whether the access touches the watched range.
+func (wp Watchpoint) matches(a memAccess) bool {
+	if a.write && !wp.Write || !a.write && !wp.Read {
+		return false
+	}
+	in := func(addr int) bool {
+		return addr >= wp.Start && addr < wp.End
+	}
+	// The high byte of a word wraps around within the segment.
+	return in(a.addr()) || a.word && in(Physical(a.seg, a.offset+1))
+}
+
+// Returns the accesses of the instruction, executed with the registers regs,
+// that are caught by the watchpoints.
+func watchHits(wps []Watchpoint, in Instruction, regs *Registers, accesses []memAccess) []WatchHit {
+	var hits []WatchHit
+	for _, a := range accesses {
+		for _, wp := range wps {
+			if wp.matches(a) {
+				hits = append(hits, WatchHit{wp, regs[RegCs], regs[RegIp], in, a})
+			}
+		}
+	}
+	return hits
+}
+
+// WatchHit is an access to memory that was caught by a watchpoint.
+type WatchHit struct {
+	Watchpoint Watchpoint
+	cs, ip     uint16 // Address of the instruction
+	in         Instruction
+	access     memAccess
+}
+
+func (h WatchHit) String() string {
+	a := h.access
+	if !a.write {
+		return fmt.Sprintf("watchpoint %s: read of [0x%x] by %s at %04x:%04x: 0x%x",
+			h.Watchpoint, a.addr(), h.in, h.cs, h.ip, a.new)
+	}
+	return fmt.Sprintf("watchpoint %s: write of [0x%x] by %s at %04x:%04x: 0x%x->0x%x",
+		h.Watchpoint, a.addr(), h.in, h.cs, h.ip, a.old, a.new)
+}